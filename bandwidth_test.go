@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+const (
+	// how long every measured game plays for
+	BANDWIDTH_REPORT_SECONDS = 10
+	// how many snapshots it takes an ack to get back to the server, and how many get lost on the way
+	BANDWIDTH_REPORT_ACK_DELAY = 2
+	BANDWIDTH_REPORT_LOSS      = 0.05
+	// radius the culled column is measured with
+	BANDWIDTH_REPORT_RADIUS = TILE_SIZE * 12
+)
+
+// BenchmarkPlayerBandwidth reports how many bytes of player updates every client gets per second,
+// for the full player list we used to send, deltas, and deltas with interest culling
+func BenchmarkPlayerBandwidth(b *testing.B) {
+	for _, count := range []int{2, 4, 8} {
+		b.Run(fmt.Sprintf("players=%d", count), func(b *testing.B) {
+			var full, delta, culled float64
+			for i := 0; i < b.N; i++ {
+				full = measureBandwidth(count, -1)
+				delta = measureBandwidth(count, 0)
+				culled = measureBandwidth(count, BANDWIDTH_REPORT_RADIUS)
+			}
+			b.ReportMetric(full, "full-B/s")
+			b.ReportMetric(delta, "delta-B/s")
+			b.ReportMetric(culled, "culled-B/s")
+		})
+	}
+}
+
+func TestPlayerBandwidth(t *testing.T) {
+	for _, count := range []int{2, 4, 8} {
+		full := measureBandwidth(count, -1)
+		delta := measureBandwidth(count, 0)
+		culled := measureBandwidth(count, BANDWIDTH_REPORT_RADIUS)
+		t.Logf("%d players: full %.0f B/s, delta %.0f B/s, culled %.0f B/s per client", count, full, delta, culled)
+
+		if delta >= full {
+			t.Errorf("%d players: deltas cost %.0f B/s, no less than the full list at %.0f B/s", count, delta, full)
+		}
+		if culled > delta {
+			t.Errorf("%d players: culling costs %.0f B/s, more than plain deltas at %.0f B/s", count, culled, delta)
+		}
+	}
+}
+
+// measureBandwidth plays out a game of count players and returns the average bytes per second a client gets.
+// Players wander around a level sized area, every now and then standing still or rolling.
+// A negative interestRadius measures the full player list instead of deltas
+func measureBandwidth(count int, interestRadius float64) float64 {
+	// the same game for every column
+	random := rand.New(rand.NewSource(int64(count)))
+
+	players := make([]ConnectedPlayer, count)
+	headings := make([]float64, count)
+	for i := range players {
+		players[i].ID = uint(i + 1)
+		// the full list carries every address, so it has to look like a real one
+		players[i].Addr = net.UDPAddr{IP: net.IPv4(203, 0, 113, byte(10+i)), Port: 40000 + random.Intn(20000)}
+		players[i].Position = Position{random.Float64() * 640, random.Float64() * 480}
+		players[i].Life = PLAYER_LIFE
+		players[i].Weapon = WeaponBow
+		players[i].RTT = uint32(30 + random.Intn(100))
+		headings[i] = random.Float64() * 2 * math.Pi
+	}
+
+	servers := make([]PlayerSnapshotHistory, count)
+	clients := make([]PlayerSnapshotHistory, count)
+	// what each client acked, on its way back to the server
+	acks := make([][]uint32, count)
+
+	frames_per_snapshot := SERVER_PLAYER_SYNC_DELAY_MS * INPUT_FRAMES_PER_SECOND / 1000
+	snapshots := BANDWIDTH_REPORT_SECONDS * 1000 / SERVER_PLAYER_SYNC_DELAY_MS
+	total := 0
+
+	for sequence := uint32(1); sequence <= uint32(snapshots); sequence++ {
+		for i := range players {
+			player := &players[i]
+			if random.Float64() < 0.05 {
+				headings[i] = random.Float64() * 2 * math.Pi
+			}
+			standing := random.Float64() < 0.2
+			player.IsRolling = !standing && random.Float64() < 0.05
+			if !standing {
+				player.Position.X = math.Mod(player.Position.X+math.Cos(headings[i])*PLAYER_SPEED*float64(frames_per_snapshot)+640, 640)
+				player.Position.Y = math.Mod(player.Position.Y+math.Sin(headings[i])*PLAYER_SPEED*float64(frames_per_snapshot)+480, 480)
+				player.Rotation = headings[i]
+				player.LastInput += uint32(frames_per_snapshot)
+			}
+		}
+
+		for i, viewer := range players {
+			w := BinaryWriter{}
+			if interestRadius < 0 {
+				encodePayload(&w, players)
+				total += len(w.Bytes())
+				continue
+			}
+
+			if len(acks[i]) >= BANDWIDTH_REPORT_ACK_DELAY {
+				servers[i].Ack(acks[i][0])
+				acks[i] = acks[i][1:]
+			}
+
+			data := servers[i].Build(sequence, players, viewer.ID, interestRadius)
+			data.EncodeBinary(&w)
+			total += len(w.Bytes())
+
+			if random.Float64() >= BANDWIDTH_REPORT_LOSS {
+				clients[i].Apply(data)
+			}
+			acks[i] = append(acks[i], clients[i].Acked())
+		}
+	}
+
+	return float64(total) / float64(count) / BANDWIDTH_REPORT_SECONDS
+}
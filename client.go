@@ -1,36 +1,69 @@
 package main
 
 import (
-	"bytes"
-	"encoding/gob"
+	"errors"
 	"fmt"
 	"net"
-	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const SERVERPORT = 8081
 const MEDIATION_SERVERPORT = 8080
+const LAN_DISCOVERY_PORT = 8082
 
 type Client struct {
-	conn                *net.UDPConn
+	conn    Transport
+	channel *NetChannel
+	// only written while handling packets, everyone else reads it through HostAddr
 	host_addr           net.UDPAddr
+	connection_mutex    sync.RWMutex
 	packet_channel      chan PacketData
-	player_states       map[string]PlayerState
+	player_states       map[uint]PlayerState
 	player_states_mutex sync.RWMutex
 	bullets             []Bullet
 	bullets_mutex       sync.RWMutex
-	is_connected        bool
-	EventQueue          []Event
-	readyPlayersCount   uint
-	playerCount         uint
-	ServerState         ServerState
-	PlayerLifePtr       *int
-	Modifiers           *Modifiers
+	is_connected        atomic.Bool
+	// protected by connection_mutex, see ConnectError
+	connect_error error
+	clock_offset  int64
+	rtt           uint32
+	// in ms, see Client.RenderTime
+	interpolation_delay int64
+	extrapolation_limit int64
+	last_packet_time    int64
+	host_left           bool
+	// fires when the host still hasn't answered a while after the mediation server told us
+	// where it is, see fallBackToRelay
+	relay_fallback    <-chan time.Time
+	relay_key         string
+	closed            atomic.Bool
+	EventQueue        []Event
+	readyPlayersCount uint
+	playerCount       uint
+	ServerState       ServerState
+	PlayerLifePtr     *int
+	Modifiers         *Modifiers
+
+	// movement we have predicted but the server hasn't applied yet, only touched from Game.Update
+	next_input     uint32
+	pending_inputs []PlayerInput
+	// our own entry from the last player update, protected by player_states_mutex
+	authoritative_state     ConnectedPlayer
+	has_authoritative_state bool
+	// enemy snapshots waiting for Game.UpdateEnemies
+	enemy_updates       []enemyUpdate
+	enemy_updates_mutex sync.Mutex
+	// the player snapshots we got, the server sends deltas against the newest one we acked
+	player_snapshots PlayerSnapshotHistory
+	snapshot_ack     atomic.Uint32
+	// seed of the host's current run, shown in the waiting room so a run can be played again
+	seed atomic.Int64
 
 	ID uint
+	// given to us by the host, sending it when negotiating again gets us our old player back
+	SessionToken uint64
 }
 
 type Bullet struct {
@@ -40,30 +73,33 @@ type Bullet struct {
 	Speed       float32
 	GracePeriod float64
 	HurtsPlayer bool
+	// the server time the shooter was seeing enemies at, see Client.RenderTime
+	ViewTime int64
+	// how far back the server checks the bullet's hits, only known to the server, see RewindFor
+	rewind int64
 }
 
 type PlayerState struct {
-	Connection          ConnectedPlayer
-	PreviousPos         Position
-	PreviousRelativePos Position
-	CurrentPos          Position
-	MoveDuration        int
-	FrameCount          uint
-	RollDuration        float64
-	RollSpeed           float64
+	Connection ConnectedPlayer
+	// every recent update of the player, stamped with the server's clock
+	Snapshots    SnapshotBuffer
+	MoveDuration int
+	RollDuration float64
+	RTT          time.Duration
 }
 
 type PlayerUpdateData struct {
-	Position  Position
-	Rotation  float64
-	Weapon    WeaponType
-	isRolling bool
-	Life      int
+	// every input the server hasn't acknowledged yet, oldest first
+	Inputs   []PlayerInput
+	Rotation float64
+	Weapon   WeaponType
+	// the newest player snapshot we have, see PlayerSnapshotHistory
+	SnapshotAck uint32
 }
 
 func (c *Client) Self() *ConnectedPlayer {
 	for _, player := range c.player_states {
-		if c.IsSelf(player.Connection.Addr) {
+		if c.IsSelf(player.Connection.ID) {
 			return &player.Connection
 		}
 	}
@@ -71,41 +107,57 @@ func (c *Client) Self() *ConnectedPlayer {
 	return nil
 }
 
-func (c *Client) GetStateByAddr(addr string) *PlayerState {
-	for _, player := range c.player_states {
-		if player.Connection.Addr.String() == addr {
-			return &player
-		}
+func (c *Client) GetStateByID(id uint) *PlayerState {
+	player, ok := c.player_states[id]
+	if !ok {
+		return nil
 	}
-	return nil
+	return &player
+}
+
+// where the server last said the player is, which is ahead of where we show it
+func (ps *PlayerState) LatestPos() Position {
+	return ps.Snapshots.Latest().Position
+}
+
+// where and how we show the player this frame, see Client.RenderTime
+func (c *Client) RenderState(ps *PlayerState) Snapshot {
+	return ps.Snapshots.Sample(c.RenderTime(), c.extrapolation_limit)
+}
+
+// the server's clock as estimated from its pings
+func (c *Client) ServerTime() int64 {
+	return NowMillis() - c.clock_offset
 }
 
-func (ps *PlayerState) GetInterpolatedPos() Position {
-	// estimated frame count between packets
-	// f := 1000.0 / SERVER_PLAYER_SYNC_DELAY_MS
-	f := 6.0
+// the server time remote entities are shown at, far enough in the past that we have updates on either side of it
+func (c *Client) RenderTime() int64 {
+	return c.ServerTime() - c.interpolation_delay
+}
 
-	x := ps.PreviousPos.X + float64(ps.FrameCount)/f*(ps.CurrentPos.X-ps.PreviousPos.X)
-	y := ps.PreviousPos.Y + float64(ps.FrameCount)/f*(ps.CurrentPos.Y-ps.PreviousPos.Y)
+func (c *Client) SetInterpolation(config Config) {
+	c.interpolation_delay = int64(config.InterpolationDelayMs)
+	c.extrapolation_limit = int64(config.ExtrapolationLimitMs)
+}
 
-	return Position{x, y}
+func (c *Client) RTT() time.Duration {
+	return time.Duration(c.rtt) * time.Millisecond
 }
 
 func (c *Client) ToggleReady() {
 	packet := Packet{}
 	packet.PacketType = PacketTypeClientToggleReady
 
-	raw_data, err := SerializePacket(packet, Packet{}) // this second packet is dead
+	host_addr := c.HostAddr()
+	err := c.channel.Send(packet, nil, &host_addr)
 	if err != nil {
-		fmt.Println("error serializing ready packet", err)
+		fmt.Println("error sending ready packet", err)
 	}
-
-	c.conn.WriteToUDP(raw_data, &c.host_addr)
 }
 
 func (c *Client) IsReady() bool {
 	for _, player := range c.player_states {
-		if c.IsSelf(player.Connection.Addr) {
+		if c.IsSelf(player.Connection.ID) {
 			return player.Connection.IsReady
 		}
 	}
@@ -114,101 +166,140 @@ func (c *Client) IsReady() bool {
 	return false
 }
 
-func (c *Client) IsSelf(addr net.UDPAddr) bool {
-	split_strings := strings.Split(c.conn.LocalAddr().String(), ":")
-
-	port, _ := strconv.Atoi(split_strings[len(split_strings)-1])
-
-	if addr.Port == port {
-		return true
-	}
-
-	return false
+// ids start at 1, so nothing is us before the host has told us who we are
+func (c *Client) IsSelf(id uint) bool {
+	return c.ID != 0 && id == c.ID
 }
 
 func (c *Client) SendChosenModifiers(modifiers Modifiers) {
 	packet := Packet{}
 	packet.PacketType = PacketTypeModifierChosen
 
-	raw_data, err := SerializePacket(packet, modifiers)
+	host_addr := c.HostAddr()
+	err := c.channel.Send(packet, modifiers, &host_addr)
 	if err != nil {
-		fmt.Println("error serializing modifiers packet", err)
+		fmt.Println("error sending modifiers packet", err)
 	}
-
-	c.conn.WriteToUDP(raw_data, &c.host_addr)
 }
 
-func (c *Client) SendHit(hit HitInfo) {
+func (c *Client) SendShoot(bullet Bullet) {
 	packet := Packet{}
-	packet.PacketType = PacketTypePlayerHit
+	packet.PacketType = PacketTypeBulletStart
 
-	raw_data, err := SerializePacket(packet, hit)
+	host_addr := c.HostAddr()
+	err := c.channel.Send(packet, bullet, &host_addr)
 	if err != nil {
-		fmt.Println("error serializing bullet packet", err)
+		fmt.Println("error sending bullet packet", err)
 	}
-
-	c.conn.WriteToUDP(raw_data, &c.host_addr)
 }
 
-func (c *Client) SendShoot(bullet Bullet) {
+// Disconnect tells the host we are leaving and closes the connection. Nothing will ack it
+// once we are gone, so it is sent a few times instead of reliably
+func (c *Client) Disconnect() {
+	if c.channel == nil {
+		return
+	}
+
 	packet := Packet{}
-	packet.PacketType = PacketTypeBulletStart
+	packet.PacketType = PacketTypeDisconnect
 
-	raw_data, err := SerializePacket(packet, bullet)
-	if err != nil {
-		fmt.Println("error serializing bullet packet", err)
+	host_addr := c.HostAddr()
+	for i := 0; i < DISCONNECT_REDUNDANCY; i++ {
+		err := c.channel.Send(packet, nil, &host_addr)
+		if err != nil {
+			fmt.Println("error sending disconnect packet", err)
+			break
+		}
 	}
 
-	c.conn.WriteToUDP(raw_data, &c.host_addr)
+	c.Close()
 }
 
-func (c *Client) SendRoll() {
-	packet := Packet{}
-	packet.PacketType = PacketTypePlayerRoll
+func (c *Client) Close() {
+	c.closed.Store(true)
+	if c.channel != nil {
+		c.channel.Close()
+	}
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
 
-	raw_data, err := SerializePacket(packet, Packet{})
-	if err != nil {
-		fmt.Println("error serializing roll packet", err)
+// true once the host has said goodbye, we haven't heard from it in a while
+// or it stopped acking what we send
+func (c *Client) LostConnection() bool {
+	if !c.is_connected.Load() {
+		return false
 	}
+	host_addr := c.HostAddr()
+	return c.host_left || NowMillis()-c.last_packet_time > TIMEOUT_INTERVAL_MS || c.channel.IsPeerLost(&host_addr)
+}
 
-	c.conn.WriteToUDP(raw_data, &c.host_addr)
+func (c *Client) IsConnected() bool {
+	return c.is_connected.Load()
+}
+
+func (c *Client) HostAddr() net.UDPAddr {
+	c.connection_mutex.RLock()
+	defer c.connection_mutex.RUnlock()
+	return c.host_addr
+}
+
+func (c *Client) setHostAddr(addr net.UDPAddr) {
+	c.connection_mutex.Lock()
+	c.host_addr = addr
+	c.connection_mutex.Unlock()
 }
 
 func (c *Client) listen() {
-	buf := make([]byte, 2048)
+	buf := make([]byte, READ_BUFFER_SIZE)
 	for {
 		n, addr, err := c.conn.ReadFromUDP(buf)
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			fmt.Println("error reading", err)
+			continue
 		}
 
 		packet, data, err := DeserializePacket(buf[:n])
 		if err != nil {
-			fmt.Println("error reading", err)
+			fmt.Println("dropping invalid packet from", addr, err)
+			continue
 		}
 
-		packet_data := PacketData{packet, data, *addr}
-		c.packet_channel <- packet_data
+		packet_data, err := c.channel.Unwrap(PacketData{packet, data, *addr})
+		if err != nil {
+			fmt.Println("dropping relayed packet from", addr, err)
+			continue
+		}
+
+		for _, ready := range c.channel.Receive(packet_data) {
+			c.packet_channel <- ready
+		}
 	}
 }
 
-func (c *Client) SendPosition(pos Position, rotation float64, weapon WeaponType, isRolling bool, life int) {
+// SendInputs sends every input the server hasn't acknowledged, so a lost packet costs nothing
+// as long as the next one arrives
+func (c *Client) SendInputs(rotation float64, weapon WeaponType) {
 	packet := Packet{}
 	packet.PacketType = PacketTypeUpdateCurrentPlayer
 
-	raw_data, err := SerializePacket(packet,
+	inputs := c.pending_inputs[max(0, len(c.pending_inputs)-MAX_INPUTS_PER_PACKET):]
+	host_addr := c.HostAddr()
+
+	err := c.channel.Send(packet,
 		PlayerUpdateData{
-			pos,
+			inputs,
 			rotation,
 			weapon,
-			isRolling,
-			life,
-		})
+			c.snapshot_ack.Load(),
+		}, &host_addr)
 	if err != nil {
-		fmt.Println("error serializing coordinate packet", err)
+		fmt.Println("error sending input packet", err)
 	}
-
-	c.conn.WriteToUDP(raw_data, &c.host_addr)
 }
 
 func (c *Client) HandleServerState(state ServerState) {
@@ -250,16 +341,56 @@ func (c *Client) HandleServerState(state ServerState) {
 	}
 }
 
-func (c *Client) RunLocalClient() {
-	conn, err := net.ListenUDP("udp", nil)
+func (c *Client) Seed() int64 {
+	return c.seed.Load()
+}
+
+// UseTransport makes the client talk through transport instead of opening a socket,
+// which is how it runs on a MemoryNetwork
+func (c *Client) UseTransport(transport Transport) {
+	c.conn = transport
+}
+
+func (c *Client) openTransport(config Config) error {
+	if c.conn != nil {
+		return nil
+	}
+
+	conn, err := ListenTransport(config, nil)
+	if err != nil {
+		return fmt.Errorf("error dialing UDP: %w", err)
+	}
 	c.conn = conn
+	return nil
+}
+
+// run handles packets until the client is closed, unless it couldn't start in the first place
+func (c *Client) run(err error) {
+	if c.conn != nil {
+		defer c.conn.Close()
+	}
 	if err != nil {
-		fmt.Println("Error dialing UDP:", err)
+		fmt.Println(err)
 		return
 	}
-	defer conn.Close()
 
-	data := ReconcilliationData{"Hello, server!"}
+	for !c.closed.Load() {
+		c.HandlePacket()
+	}
+}
+
+func (c *Client) RunLocalClient(config Config) {
+	c.run(c.StartLocalClient(config))
+}
+
+// StartLocalClient connects to the server in our own process, packets are left for Step or RunLocalClient to handle
+func (c *Client) StartLocalClient(config Config) error {
+	err := c.openTransport(config)
+	if err != nil {
+		return err
+	}
+
+	data := NegotiationRequest{"Hello, server!", 0}
 
 	packet := Packet{}
 
@@ -269,183 +400,324 @@ func (c *Client) RunLocalClient() {
 	packet.PacketType = PacketTypeNegotiate
 
 	// we know the host addr because we are the host addr
-	c.host_addr = net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: SERVERPORT}
+	c.setHostAddr(config.LocalServerAddr())
 
 	// we know that he is connected be cause he is us
-	c.is_connected = true
+	c.is_connected.Store(true)
 
-	raw_data, _ := SerializePacket(packet, data)
-	_, err = conn.WriteToUDP(raw_data, &c.host_addr)
+	c.channel = NewNetChannel(c.conn)
+	err = c.channel.Send(packet, data, &c.host_addr)
 	if err != nil {
-		fmt.Println("Error sending data:", err)
-		return
+		return fmt.Errorf("error sending data: %w", err)
 	}
 
 	c.packet_channel = make(chan PacketData)
 
 	go c.listen()
-
-	for {
-		c.HandlePacket()
-	}
+	go c.channel.resendLoop()
+	return nil
 }
 
+// HandlePacket waits for the next packet and handles it. If none comes for a while
+// we send a keepalive so the host doesn't time us out
 func (c *Client) HandlePacket() {
 	select {
 	case packet_data := <-c.packet_channel:
-		dec := gob.NewDecoder(bytes.NewReader(packet_data.Data))
-		switch packet_data.Packet.PacketType {
-		case PacketTypeMatchConnect:
-			err := dec.Decode(&c.host_addr)
+		c.handlePacket(packet_data)
+	case <-c.relay_fallback:
+		c.fallBackToRelay()
+	case <-time.After(5 * time.Second):
+		if c.closed.Load() {
+			return
+		}
 
-			fmt.Println(packet_data.Packet, c.host_addr)
+		packet := Packet{}
+		packet.PacketType = PacketTypeKeepAlive
+		data := ReconcilliationData{"keepalive"}
 
-			packet := Packet{}
-			packet.PacketType = PacketTypeNegotiate
-			data := ReconcilliationData{"Hey other client!"}
+		err := c.channel.Send(packet, data, &c.host_addr)
+		if err != nil {
+			fmt.Println("something went wrong when keeping alive", err)
+		}
+	}
+}
 
-			raw_data, err := SerializePacket(packet, data)
-			if err != nil {
-				fmt.Println("error serializing packet", err)
-			}
+// Step handles the packets that have arrived without waiting for more, for driving the client by hand.
+// It returns how many it handled
+func (c *Client) Step() int {
+	handled := 0
+	for {
+		select {
+		case packet_data := <-c.packet_channel:
+			c.handlePacket(packet_data)
+			handled++
+		case <-c.relay_fallback:
+			c.fallBackToRelay()
+		default:
+			return handled
+		}
+	}
+}
 
-			_, err = c.conn.WriteToUDP(raw_data, &c.host_addr)
-			if err != nil {
-				fmt.Println("something went wrong when reaching out to match", err)
-			}
+func (c *Client) handlePacket(packet_data PacketData) {
+	if packet_data.Addr.String() == c.host_addr.String() {
+		c.last_packet_time = NowMillis()
+	}
 
-			c.is_connected = true
-		case PacketTypeBulletStart:
-			var bullet Bullet
-			err := dec.Decode(&bullet)
+	dec := NewDecoder(packet_data.Data)
+	switch packet_data.Packet.PacketType {
+	case PacketTypeMatchConnect:
+		var host_addr net.UDPAddr
+		err := dec.Decode(&host_addr)
+		if err != nil {
+			fmt.Println("something went wrong decoding match address", err)
+			break
+		}
+		c.setHostAddr(host_addr)
+		if c.relay_key != "" {
+			c.relay_fallback = time.After(time.Millisecond * RELAY_FALLBACK_MS)
+		}
 
-			if err != nil {
-				fmt.Println("something went wrong decoding bullet", err)
-			}
-			c.bullets_mutex.Lock()
-			c.bullets = append(c.bullets, bullet)
-			c.bullets_mutex.Unlock()
+		packet := Packet{}
+		packet.PacketType = PacketTypeNegotiate
+		data := NegotiationRequest{"Hey other client!", c.SessionToken}
 
-		case PacketTypePlayerHit:
-			var hitInfo HitInfo
-			err := dec.Decode(&hitInfo)
+		err = c.channel.Send(packet, data, &c.host_addr)
+		if err != nil {
+			fmt.Println("something went wrong when reaching out to match", err)
+		}
+	case PacketTypeBulletStart:
+		var bullet Bullet
+		err := dec.Decode(&bullet)
 
-			if c.IsSelf(hitInfo.Player.Addr) {
-				// double check this
-				*c.PlayerLifePtr -= hitInfo.Damage
-			}
-			state := c.GetStateByAddr(hitInfo.Player.Addr.String())
-			if state.Connection.Life-hitInfo.Damage < 1 {
-				event := Event{}
-				event.Type = PlayerDiedEvent
-				event.Player = state.Connection
+		if err != nil {
+			fmt.Println("something went wrong decoding bullet", err)
+			break
+		}
+		c.bullets_mutex.Lock()
+		c.bullets = append(c.bullets, bullet)
+		c.bullets_mutex.Unlock()
 
-				c.EventQueue = append(c.EventQueue, event)
-			}
+	case PacketTypePlayerHit:
+		var hitInfo HitInfo
+		err := dec.Decode(&hitInfo)
+		if err != nil {
+			fmt.Println("something went wrong when decoding hit info", err)
+			break
+		}
 
-			if err != nil {
-				fmt.Println("something went wrong when decoding hit info", err)
-			}
+		if c.IsSelf(hitInfo.PlayerID) {
+			*c.PlayerLifePtr = hitInfo.Life
+		}
+		state := c.GetStateByID(hitInfo.PlayerID)
+		if state != nil && hitInfo.Life < 1 {
+			event := Event{}
+			event.Type = PlayerDiedEvent
+			event.Player = state.Connection
 
-		case PacketTypeUpdatePlayers:
-			var connections []ConnectedPlayer
-			states := make(map[string]PlayerState)
-			err := dec.Decode(&connections)
+			c.EventQueue = append(c.EventQueue, event)
+		}
 
-			if err != nil {
-				fmt.Println("something went wrong when updating connections", err)
-			}
+	case PacketTypeUpdatePlayers:
+		var snapshot PlayerSnapshotData
+		states := make(map[uint]PlayerState)
+		err := dec.Decode(&snapshot)
 
-			c.player_states_mutex.Lock()
-			var readyPlayerCount uint = 0
-			for _, pConn := range connections {
-				id := pConn.Addr.String()
-				ps, ok := c.player_states[id]
-				if pConn.IsReady {
-					readyPlayerCount++
-				}
-				if ok {
-					ps.Connection = pConn
-					ps.PreviousPos = ps.CurrentPos
-					ps.CurrentPos = pConn.Position
-					ps.FrameCount = 0
-					ps.RollDuration = min(0, ps.RollDuration+ps.RollSpeed*0.085)
-					states[id] = ps
-				} else {
-					states[id] = PlayerState{
-						Connection:   pConn,
-						MoveDuration: 0,
-						FrameCount:   0,
-						PreviousPos:  pConn.Position,
-						CurrentPos:   pConn.Position,
-					}
-				}
-			}
-			c.readyPlayersCount = readyPlayerCount
-			c.playerCount = uint(len(c.player_states))
+		if err != nil {
+			fmt.Println("something went wrong when updating connections", err)
+			break
+		}
+
+		// older than what we have, or against a baseline we forgot, the next one will do
+		players, ok := c.player_snapshots.Apply(snapshot)
+		if !ok {
+			break
+		}
+		c.snapshot_ack.Store(c.player_snapshots.Acked())
+
+		connections := make([]ConnectedPlayer, 0, len(players))
+		for _, player := range players {
+			connections = append(connections, player.ConnectedPlayer())
+		}
 
-			c.player_states = states
-			c.player_states_mutex.Unlock()
+		c.player_states_mutex.Lock()
+		var readyPlayerCount uint = 0
+		for _, pConn := range connections {
+			id := pConn.ID
+			ps, ok := c.player_states[id]
+			if pConn.IsReady {
+				readyPlayerCount++
+			}
+			if c.IsSelf(id) {
+				c.authoritative_state = pConn
+				c.has_authoritative_state = true
+			}
+			if !ok {
+				ps = PlayerState{Connection: pConn, MoveDuration: 0}
+			}
 
-		case PacketTypeNegotiate:
-			_ = dec.Decode(&c.ID)
+			ps.Connection = pConn
+			ps.Snapshots.Push(Snapshot{int64(packet_data.Packet.Timestamp), pConn.Position, pConn.Rotation})
+			ps.RTT = time.Duration(pConn.RTT) * time.Millisecond
+			ps.RollDuration = pConn.RollDuration
+			states[id] = ps
+		}
+		c.readyPlayersCount = readyPlayerCount
+		c.playerCount = uint(len(c.player_states))
 
-			c.host_addr = packet_data.Addr
-			fmt.Println(c.ID)
+		c.player_states = states
+		c.player_states_mutex.Unlock()
 
-		case PacketTypeServerStateChanged:
-			var state ServerState
-			_ = dec.Decode(&state)
+	case PacketTypeUpdateEnemies:
+		var enemies EnemySnapshotData
+		err := dec.Decode(&enemies)
+		if err != nil {
+			fmt.Println("something went wrong decoding enemies", err)
+			break
+		}
+		c.queueEnemyUpdate(enemyUpdate{int64(packet_data.Packet.Timestamp), enemies})
 
-			c.ServerState = state
-			c.HandleServerState(c.ServerState)
+	case PacketTypeNegotiate:
+		if err := CheckPacketVersion(packet_data.Packet); err != nil {
+			fmt.Printf("host has protocol version %d, we have %d\n", packet_data.Packet.Version, PROTOCOL_VERSION)
+			c.setConnectError(err)
+			break
+		}
 
-		case PacketTypeModifiersUpdated:
-			_ = dec.Decode(c.Modifiers)
+		var response NegotiationResponse
+		err := dec.Decode(&response)
+		if err != nil {
+			fmt.Println("something went wrong decoding negotiation", err)
+			break
+		}
 
-		case PacketTypeServerEvent:
-			var event Event
-			_ = dec.Decode(&event)
+		c.ID = response.ID
+		c.SessionToken = response.SessionToken
+		c.channel.SetSessionToken(response.SessionToken)
+		c.seed.Store(response.Seed)
+		c.setHostAddr(packet_data.Addr)
+		c.last_packet_time = NowMillis()
+		c.is_connected.Store(true)
+
+	case PacketTypeDisconnect:
+		if packet_data.Addr.String() == c.host_addr.String() {
+			fmt.Println("host has left")
+			c.host_left = true
+		}
 
-			c.EventQueue = append(c.EventQueue, event)
+	case PacketTypePing:
+		received := NowMillis()
 
+		var ping PingData
+		err := dec.Decode(&ping)
+		if err != nil {
+			fmt.Println("something went wrong decoding ping", err)
+			break
 		}
 
-	case <-time.After(5 * time.Second):
+		// the server does the maths, we just keep what it has figured out so far
+		c.clock_offset = ping.ClockOffset
+		c.rtt = ping.RTT
+
 		packet := Packet{}
-		packet.PacketType = PacketTypeKeepAlive
-		data := ReconcilliationData{"keepalive"}
+		packet.PacketType = PacketTypePong
+		err = c.channel.Send(packet, PongData{ping.ServerSendTime, received, NowMillis()}, &c.host_addr)
+		if err != nil {
+			fmt.Println("something went wrong answering ping", err)
+		}
 
-		serialized_packet, _ := SerializePacket(packet, data)
+	case PacketTypeError:
+		var errorData ErrorData
+		err := dec.Decode(&errorData)
+		if err != nil {
+			fmt.Println("something went wrong decoding error", err)
+			break
+		}
+
+		fmt.Println("got error from", packet_data.Addr.String(), errorData.Message)
+		c.setConnectError(errorData.Err())
 
-		_, err := c.conn.WriteToUDP(serialized_packet, &c.host_addr)
+	case PacketTypeServerStateChanged:
+		var state ServerState
+		err := dec.Decode(&state)
 		if err != nil {
-			fmt.Println("something went wrong when keeping alive", err)
+			fmt.Println("something went wrong decoding server state", err)
+			break
+		}
+
+		c.ServerState = state
+		c.seed.Store(state.Seed)
+		c.HandleServerState(c.ServerState)
+
+	case PacketTypeModifiersUpdated:
+		var modifiers Modifiers
+		err := dec.Decode(&modifiers)
+		if err != nil {
+			fmt.Println("something went wrong decoding modifiers", err)
+			break
+		}
+
+		*c.Modifiers = modifiers
+
+	case PacketTypeServerEvent:
+		var event Event
+		err := dec.Decode(&event)
+		if err != nil {
+			fmt.Println("something went wrong decoding event", err)
+			break
 		}
+
+		c.EventQueue = append(c.EventQueue, event)
+
 	}
 }
 
 func (c *Client) CheckConnected() bool {
-	endTime := time.Now().Add(time.Second * 2)
+	endTime := time.Now().Add(time.Millisecond * CONNECT_TIMEOUT_MS)
 	for {
 		if time.Now().After(endTime) {
 			return false
 		}
 
-		if c.is_connected {
+		if c.is_connected.Load() {
 			return true
 		}
+
+		if c.ConnectError() != nil {
+			return false
+		}
+
+		time.Sleep(time.Millisecond * CONNECT_POLL_MS)
 	}
 }
 
-func (c *Client) RunClient(server_ip string, key string) {
-	conn, err := net.ListenUDP("udp", nil)
-	c.conn = conn
+func (c *Client) ConnectError() error {
+	c.connection_mutex.RLock()
+	defer c.connection_mutex.RUnlock()
+	return c.connect_error
+}
+
+func (c *Client) setConnectError(err error) {
+	c.connection_mutex.Lock()
+	c.connect_error = err
+	c.connection_mutex.Unlock()
+}
+
+func (c *Client) RunClient(config Config, key string) {
+	c.run(c.StartClient(config, key))
+}
+
+// StartClient asks the mediation server to find us the host with key, packets are left for Step or RunClient to handle
+func (c *Client) StartClient(config Config, key string) error {
+	mediation_addr, err := config.ResolveMediationAddr()
 	if err != nil {
-		fmt.Println("Error dialing UDP:", err)
-		return
+		return fmt.Errorf("error resolving mediation server: %w", err)
+	}
+
+	err = c.openTransport(config)
+	if err != nil {
+		return err
 	}
-	defer conn.Close()
 
 	data := ReconcilliationData{key}
 
@@ -453,20 +725,52 @@ func (c *Client) RunClient(server_ip string, key string) {
 	packet.PacketType = PacketTypeMatchFind
 
 	// other addr is server address, and will later be routed to the other client
-	c.host_addr = net.UDPAddr{IP: net.ParseIP(server_ip), Port: MEDIATION_SERVERPORT}
+	c.setHostAddr(*mediation_addr)
+	c.relay_key = key
 
-	raw_data, _ := SerializePacket(packet, data)
-	_, err = conn.WriteToUDP(raw_data, &c.host_addr)
+	c.channel = NewNetChannel(c.conn)
+	c.channel.SetRelayServer(*mediation_addr)
+	err = c.channel.Send(packet, data, &c.host_addr)
 	if err != nil {
-		fmt.Println("Error sending data:", err)
-		return
+		return fmt.Errorf("error sending data: %w", err)
 	}
 
 	c.packet_channel = make(chan PacketData)
 
 	go c.listen()
+	go c.channel.resendLoop()
+	return nil
+}
 
-	for {
-		c.HandlePacket()
+// RunDirectClient skips the mediation server and negotiates with the host straight away,
+// which works on a LAN or with a host that has its port forwarded
+func (c *Client) RunDirectClient(config Config, host_addr net.UDPAddr) {
+	c.run(c.StartDirectClient(config, host_addr))
+}
+
+// StartDirectClient negotiates with the host at host_addr, packets are left for Step or RunDirectClient to handle
+func (c *Client) StartDirectClient(config Config, host_addr net.UDPAddr) error {
+	err := c.openTransport(config)
+	if err != nil {
+		return err
 	}
+
+	data := NegotiationRequest{"Hey other client!", c.SessionToken}
+
+	packet := Packet{}
+	packet.PacketType = PacketTypeNegotiate
+
+	c.setHostAddr(host_addr)
+
+	c.channel = NewNetChannel(c.conn)
+	err = c.channel.Send(packet, data, &c.host_addr)
+	if err != nil {
+		return fmt.Errorf("error sending data: %w", err)
+	}
+
+	c.packet_channel = make(chan PacketData)
+
+	go c.listen()
+	go c.channel.resendLoop()
+	return nil
 }
@@ -0,0 +1,84 @@
+package main
+
+import "time"
+
+const (
+	PING_INTERVAL_MS = 1000
+	// only the best of the last few samples is used, as queueing delays only ever make samples worse
+	CLOCK_SAMPLE_COUNT = 8
+)
+
+// sent by the server, carrying what the server currently thinks of the client's clock
+type PingData struct {
+	ServerSendTime int64
+	ClockOffset    int64
+	RTT            uint32
+}
+
+// the client's answer to a ping, with its own clock readings
+type PongData struct {
+	ServerSendTime    int64
+	ClientReceiveTime int64
+	ClientSendTime    int64
+}
+
+type clockSample struct {
+	offset int64
+	rtt    int64
+}
+
+// ClockSync estimates the offset between a remote clock and ours the same way NTP does.
+// Offset is remote minus local, in milliseconds
+type ClockSync struct {
+	samples []clockSample
+}
+
+func NowMillis() int64 {
+	return time.Now().UTC().UnixMilli()
+}
+
+// t0 is when we sent the ping, t1 when they received it, t2 when they answered and t3 when we got the answer
+func (cs *ClockSync) AddSample(t0, t1, t2, t3 int64) {
+	rtt := (t3 - t0) - (t2 - t1)
+	if rtt < 0 {
+		return
+	}
+
+	offset := ((t1 - t0) + (t2 - t3)) / 2
+
+	cs.samples = append(cs.samples, clockSample{offset, rtt})
+	if len(cs.samples) > CLOCK_SAMPLE_COUNT {
+		cs.samples = cs.samples[1:]
+	}
+}
+
+func (cs *ClockSync) best() (clockSample, bool) {
+	if len(cs.samples) == 0 {
+		return clockSample{}, false
+	}
+
+	best := cs.samples[0]
+	for _, sample := range cs.samples[1:] {
+		if sample.rtt < best.rtt {
+			best = sample
+		}
+	}
+	return best, true
+}
+
+func (cs *ClockSync) Synced() bool {
+	return len(cs.samples) > 0
+}
+
+func (cs *ClockSync) Offset() int64 {
+	sample, _ := cs.best()
+	return sample.offset
+}
+
+// uses the latest sample rather than the best one, as this is what is shown to players
+func (cs *ClockSync) RTT() int64 {
+	if len(cs.samples) == 0 {
+		return 0
+	}
+	return cs.samples[len(cs.samples)-1].rtt
+}
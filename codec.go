@@ -0,0 +1,855 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"time"
+)
+
+// Payloads are written with a small hand rolled codec instead of gob, as gob sends its type
+// descriptors with every packet when a new encoder is made per packet.
+//
+// Integers are varints, floats are sent as float32 and lists/strings are prefixed with their length.
+
+var ErrShortPayload = errors.New("payload is shorter than expected")
+var ErrInvalidPayload = errors.New("payload has invalid values")
+
+type BinaryEncoder interface {
+	EncodeBinary(w *BinaryWriter)
+}
+
+type BinaryDecoder interface {
+	DecodeBinary(r *BinaryReader)
+}
+
+type BinaryWriter struct {
+	buf []byte
+}
+
+func (w *BinaryWriter) Bytes() []byte {
+	return w.buf
+}
+
+func (w *BinaryWriter) WriteUint8(v uint8) {
+	w.buf = append(w.buf, v)
+}
+
+func (w *BinaryWriter) WriteUint16(v uint16) {
+	w.buf = binary.BigEndian.AppendUint16(w.buf, v)
+}
+
+func (w *BinaryWriter) WriteUint32(v uint32) {
+	w.buf = binary.BigEndian.AppendUint32(w.buf, v)
+}
+
+// used for random values like session tokens, which would only get longer as varints
+func (w *BinaryWriter) WriteUint64(v uint64) {
+	w.buf = binary.BigEndian.AppendUint64(w.buf, v)
+}
+
+func (w *BinaryWriter) WriteUvarint(v uint64) {
+	w.buf = binary.AppendUvarint(w.buf, v)
+}
+
+func (w *BinaryWriter) WriteVarint(v int64) {
+	w.buf = binary.AppendVarint(w.buf, v)
+}
+
+func (w *BinaryWriter) WriteBool(v bool) {
+	if v {
+		w.WriteUint8(1)
+	} else {
+		w.WriteUint8(0)
+	}
+}
+
+func (w *BinaryWriter) WriteFloat(v float64) {
+	w.WriteUint32(math.Float32bits(float32(v)))
+}
+
+func (w *BinaryWriter) WriteBytes(v []byte) {
+	w.WriteUvarint(uint64(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+func (w *BinaryWriter) WriteString(v string) {
+	w.WriteUvarint(uint64(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+func (w *BinaryWriter) WritePosition(v Position) {
+	w.WriteFloat(v.X)
+	w.WriteFloat(v.Y)
+}
+
+func (w *BinaryWriter) WriteAddr(v net.UDPAddr) {
+	ip := v.IP.To4()
+	if ip == nil {
+		ip = v.IP.To16()
+	}
+	w.WriteBytes(ip)
+	w.WriteUint16(uint16(v.Port))
+	w.WriteString(v.Zone)
+}
+
+// BinaryReader keeps the first error it runs into, and every read after that returns zero values,
+// so decoders can read all their fields and check Err() once at the end
+type BinaryReader struct {
+	data   []byte
+	offset int
+	err    error
+}
+
+func NewBinaryReader(data []byte) *BinaryReader {
+	return &BinaryReader{data: data}
+}
+
+func (r *BinaryReader) Err() error {
+	return r.err
+}
+
+func (r *BinaryReader) Remaining() int {
+	return len(r.data) - r.offset
+}
+
+func (r *BinaryReader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+func (r *BinaryReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || r.Remaining() < n {
+		r.fail(ErrShortPayload)
+		return nil
+	}
+	b := r.data[r.offset : r.offset+n]
+	r.offset += n
+	return b
+}
+
+func (r *BinaryReader) ReadUint8() uint8 {
+	b := r.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *BinaryReader) ReadUint16() uint16 {
+	b := r.next(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (r *BinaryReader) ReadUint32() uint32 {
+	b := r.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *BinaryReader) ReadUint64() uint64 {
+	b := r.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (r *BinaryReader) ReadUvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data[r.offset:])
+	if n <= 0 {
+		r.fail(ErrShortPayload)
+		return 0
+	}
+	r.offset += n
+	return v
+}
+
+func (r *BinaryReader) ReadVarint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.data[r.offset:])
+	if n <= 0 {
+		r.fail(ErrShortPayload)
+		return 0
+	}
+	r.offset += n
+	return v
+}
+
+func (r *BinaryReader) ReadBool() bool {
+	return r.ReadUint8() != 0
+}
+
+func (r *BinaryReader) ReadFloat() float64 {
+	return float64(math.Float32frombits(r.ReadUint32()))
+}
+
+// ReadCount reads the length prefix of a list where every element takes at least minSize bytes,
+// so a corrupt length can never make us allocate more than the packet could hold
+func (r *BinaryReader) ReadCount(minSize int) int {
+	count := r.ReadUvarint()
+	if r.err != nil {
+		return 0
+	}
+	if count > uint64(r.Remaining()/max(1, minSize)) {
+		r.fail(ErrShortPayload)
+		return 0
+	}
+	return int(count)
+}
+
+func (r *BinaryReader) ReadBytes() []byte {
+	b := r.next(r.ReadCount(1))
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+func (r *BinaryReader) ReadString() string {
+	return string(r.next(r.ReadCount(1)))
+}
+
+func (r *BinaryReader) ReadPosition() Position {
+	x := r.ReadFloat()
+	y := r.ReadFloat()
+	return Position{x, y}
+}
+
+// levels are loaded from disk by their number, so an unknown one would make us panic
+func (r *BinaryReader) ReadLevel() LevelEnum {
+	level := r.ReadUvarint()
+	if level >= uint64(LevelCount) {
+		r.fail(fmt.Errorf("%w: level %d", ErrInvalidPayload, level))
+		return LobbyLevel
+	}
+	return LevelEnum(level)
+}
+
+func (r *BinaryReader) ReadAddr() net.UDPAddr {
+	ip := r.ReadBytes()
+	port := r.ReadUint16()
+	zone := r.ReadString()
+	if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+		r.fail(fmt.Errorf("address has invalid ip length %d", len(ip)))
+		return net.UDPAddr{}
+	}
+	return net.UDPAddr{IP: net.IP(ip), Port: int(port), Zone: zone}
+}
+
+func encodePayload(w *BinaryWriter, data any) error {
+	switch v := data.(type) {
+	case nil:
+	case BinaryEncoder:
+		v.EncodeBinary(w)
+	case uint:
+		w.WriteUvarint(uint64(v))
+	case net.UDPAddr:
+		w.WriteAddr(v)
+	case []ConnectedPlayer:
+		w.WriteUvarint(uint64(len(v)))
+		for _, player := range v {
+			player.EncodeBinary(w)
+		}
+	default:
+		return fmt.Errorf("no binary encoding for %T", data)
+	}
+	return nil
+}
+
+// Decoder mirrors the gob.Decoder api so packet handlers can decode payloads the same way they used to
+type Decoder struct {
+	r *BinaryReader
+}
+
+func NewDecoder(data []byte) *Decoder {
+	return &Decoder{NewBinaryReader(data)}
+}
+
+func (d *Decoder) Decode(data any) error {
+	switch v := data.(type) {
+	case BinaryDecoder:
+		v.DecodeBinary(d.r)
+	case *uint:
+		*v = uint(d.r.ReadUvarint())
+	case *net.UDPAddr:
+		*v = d.r.ReadAddr()
+	case *[]ConnectedPlayer:
+		players := make([]ConnectedPlayer, d.r.ReadCount(1))
+		for i := range players {
+			players[i].DecodeBinary(d.r)
+		}
+		*v = players
+	default:
+		return fmt.Errorf("no binary decoding for %T", data)
+	}
+	return d.r.Err()
+}
+
+func (d ReconcilliationData) EncodeBinary(w *BinaryWriter) {
+	w.WriteString(d.Name)
+}
+
+func (d *ReconcilliationData) DecodeBinary(r *BinaryReader) {
+	d.Name = r.ReadString()
+}
+
+func (d ErrorData) EncodeBinary(w *BinaryWriter) {
+	w.WriteUint8(uint8(d.Code))
+	w.WriteString(d.Message)
+	w.WriteUint16(d.Version)
+}
+
+func (d *ErrorData) DecodeBinary(r *BinaryReader) {
+	d.Code = ErrorCode(r.ReadUint8())
+	d.Message = r.ReadString()
+	d.Version = r.ReadUint16()
+}
+
+func (d RelayData) EncodeBinary(w *BinaryWriter) {
+	w.WriteAddr(d.Peer)
+	w.WriteBytes(d.Datagram)
+}
+
+func (d *RelayData) DecodeBinary(r *BinaryReader) {
+	d.Peer = r.ReadAddr()
+	d.Datagram = r.ReadBytes()
+}
+
+func (d AckData) EncodeBinary(w *BinaryWriter) {
+	w.WriteUint32(d.Sequence)
+}
+
+func (d *AckData) DecodeBinary(r *BinaryReader) {
+	d.Sequence = r.ReadUint32()
+}
+
+func (d FragmentData) EncodeBinary(w *BinaryWriter) {
+	w.WriteUint32(d.ID)
+	w.WriteUint16(d.Index)
+	w.WriteUint16(d.Count)
+	w.WriteBytes(d.Chunk)
+}
+
+func (d *FragmentData) DecodeBinary(r *BinaryReader) {
+	d.ID = r.ReadUint32()
+	d.Index = r.ReadUint16()
+	d.Count = r.ReadUint16()
+	d.Chunk = r.ReadBytes()
+}
+
+func (d PingData) EncodeBinary(w *BinaryWriter) {
+	w.WriteVarint(d.ServerSendTime)
+	w.WriteVarint(d.ClockOffset)
+	w.WriteUvarint(uint64(d.RTT))
+}
+
+func (d *PingData) DecodeBinary(r *BinaryReader) {
+	d.ServerSendTime = r.ReadVarint()
+	d.ClockOffset = r.ReadVarint()
+	d.RTT = uint32(r.ReadUvarint())
+}
+
+func (d HostMetadata) EncodeBinary(w *BinaryWriter) {
+	w.WriteString(d.HostName)
+	w.WriteUvarint(uint64(d.PlayerCount))
+	w.WriteUvarint(uint64(d.ReadyCount))
+	w.WriteUvarint(uint64(d.Level))
+}
+
+func (d *HostMetadata) DecodeBinary(r *BinaryReader) {
+	d.HostName = r.ReadString()
+	d.PlayerCount = uint(r.ReadUvarint())
+	d.ReadyCount = uint(r.ReadUvarint())
+	d.Level = r.ReadLevel()
+}
+
+func (d LobbyInfo) EncodeBinary(w *BinaryWriter) {
+	w.WriteString(d.Code)
+	w.WriteString(d.HostName)
+	w.WriteUvarint(uint64(d.PlayerCount))
+	w.WriteUvarint(uint64(d.ReadyCount))
+	w.WriteUvarint(uint64(d.Level))
+	w.WriteUint16(d.Version)
+}
+
+func (d *LobbyInfo) DecodeBinary(r *BinaryReader) {
+	d.Code = r.ReadString()
+	d.HostName = r.ReadString()
+	d.PlayerCount = uint(r.ReadUvarint())
+	d.ReadyCount = uint(r.ReadUvarint())
+	d.Level = r.ReadLevel()
+	d.Version = r.ReadUint16()
+}
+
+func (d LobbyListData) EncodeBinary(w *BinaryWriter) {
+	w.WriteUvarint(uint64(len(d.Lobbies)))
+	for _, lobby := range d.Lobbies {
+		lobby.EncodeBinary(w)
+	}
+}
+
+func (d *LobbyListData) DecodeBinary(r *BinaryReader) {
+	d.Lobbies = make([]LobbyInfo, r.ReadCount(7))
+	for i := range d.Lobbies {
+		d.Lobbies[i].DecodeBinary(r)
+	}
+}
+
+func (d LanAnnounceData) EncodeBinary(w *BinaryWriter) {
+	w.WriteString(d.Code)
+	w.WriteUvarint(uint64(d.PlayerCount))
+	w.WriteBool(d.Started)
+}
+
+func (d *LanAnnounceData) DecodeBinary(r *BinaryReader) {
+	d.Code = r.ReadString()
+	d.PlayerCount = uint(r.ReadUvarint())
+	d.Started = r.ReadBool()
+}
+
+func (d PongData) EncodeBinary(w *BinaryWriter) {
+	w.WriteVarint(d.ServerSendTime)
+	w.WriteVarint(d.ClientReceiveTime)
+	w.WriteVarint(d.ClientSendTime)
+}
+
+func (d *PongData) DecodeBinary(r *BinaryReader) {
+	d.ServerSendTime = r.ReadVarint()
+	d.ClientReceiveTime = r.ReadVarint()
+	d.ClientSendTime = r.ReadVarint()
+}
+
+func (d ServerStateData) EncodeBinary(w *BinaryWriter) {
+	w.WriteUvarint(uint64(d.LevelEnum))
+	w.WriteVarint(d.Timestamp.UnixMilli())
+}
+
+func (d *ServerStateData) DecodeBinary(r *BinaryReader) {
+	d.LevelEnum = r.ReadLevel()
+	d.Timestamp = time.UnixMilli(r.ReadVarint())
+}
+
+func (d CoordinateData) EncodeBinary(w *BinaryWriter) {
+	w.WriteFloat(float64(d.X))
+	w.WriteFloat(float64(d.Y))
+}
+
+func (d *CoordinateData) DecodeBinary(r *BinaryReader) {
+	d.X = float32(r.ReadFloat())
+	d.Y = float32(r.ReadFloat())
+}
+
+func (d NegotiationRequest) EncodeBinary(w *BinaryWriter) {
+	w.WriteString(d.Name)
+	w.WriteUint64(d.SessionToken)
+}
+
+func (d *NegotiationRequest) DecodeBinary(r *BinaryReader) {
+	d.Name = r.ReadString()
+	d.SessionToken = r.ReadUint64()
+}
+
+func (d NegotiationResponse) EncodeBinary(w *BinaryWriter) {
+	w.WriteAddr(d.Addr)
+	w.WriteUvarint(uint64(d.ID))
+	w.WriteUint64(d.SessionToken)
+	w.WriteBool(d.Reconnected)
+	w.WriteVarint(d.Seed)
+}
+
+func (d *NegotiationResponse) DecodeBinary(r *BinaryReader) {
+	d.Addr = r.ReadAddr()
+	d.ID = uint(r.ReadUvarint())
+	d.SessionToken = r.ReadUint64()
+	d.Reconnected = r.ReadBool()
+	d.Seed = r.ReadVarint()
+}
+
+func (p ConnectedPlayer) EncodeBinary(w *BinaryWriter) {
+	w.WriteAddr(p.Addr)
+	w.WritePosition(p.Position)
+	w.WriteFloat(p.Rotation)
+	w.WriteUvarint(uint64(p.Weapon))
+	w.WriteBool(p.IsRolling)
+	w.WriteBool(p.IsReady)
+	w.WriteUvarint(p.TimeLastPacket)
+	w.WriteVarint(int64(p.Life))
+	w.WritePosition(p.DeadPosition)
+	w.WriteUvarint(uint64(p.ID))
+	w.WriteUvarint(uint64(p.RTT))
+	w.WriteUvarint(uint64(p.LastInput))
+	w.WriteFloat(p.RollDuration)
+	w.WriteFloat(p.RollCooldown)
+}
+
+func (p *ConnectedPlayer) DecodeBinary(r *BinaryReader) {
+	p.Addr = r.ReadAddr()
+	p.Position = r.ReadPosition()
+	p.Rotation = r.ReadFloat()
+	p.Weapon = WeaponType(r.ReadUvarint())
+	p.IsRolling = r.ReadBool()
+	p.IsReady = r.ReadBool()
+	p.TimeLastPacket = r.ReadUvarint()
+	p.Life = int(r.ReadVarint())
+	p.DeadPosition = r.ReadPosition()
+	p.ID = uint(r.ReadUvarint())
+	p.RTT = uint32(r.ReadUvarint())
+	p.LastInput = uint32(r.ReadUvarint())
+	p.RollDuration = r.ReadFloat()
+	p.RollCooldown = r.ReadFloat()
+}
+
+// only the fields the delta carries are written
+func (d PlayerDelta) EncodeBinary(w *BinaryWriter) {
+	state := d.State
+	w.WriteUvarint(uint64(state.ID))
+	w.WriteUvarint(uint64(d.Fields))
+	if d.Fields&PlayerFieldPosition != 0 {
+		w.WriteVarint(int64(state.X))
+		w.WriteVarint(int64(state.Y))
+	}
+	if d.Fields&PlayerFieldRotation != 0 {
+		w.WriteUint16(state.Rotation)
+	}
+	if d.Fields&PlayerFieldWeapon != 0 {
+		w.WriteUvarint(uint64(state.Weapon))
+	}
+	if d.Fields&PlayerFieldRoll != 0 {
+		w.WriteBool(state.IsRolling)
+		w.WriteFloat(state.RollDuration)
+		w.WriteFloat(state.RollCooldown)
+	}
+	if d.Fields&PlayerFieldReady != 0 {
+		w.WriteBool(state.IsReady)
+	}
+	if d.Fields&PlayerFieldLife != 0 {
+		w.WriteVarint(int64(state.Life))
+	}
+	if d.Fields&PlayerFieldDeadPosition != 0 {
+		w.WriteVarint(int64(state.DeadX))
+		w.WriteVarint(int64(state.DeadY))
+	}
+	if d.Fields&PlayerFieldRTT != 0 {
+		w.WriteUvarint(uint64(state.RTT))
+	}
+	if d.Fields&PlayerFieldLastInput != 0 {
+		w.WriteUvarint(uint64(state.LastInput))
+	}
+}
+
+func (d *PlayerDelta) DecodeBinary(r *BinaryReader) {
+	state := &d.State
+	state.ID = uint(r.ReadUvarint())
+	d.Fields = uint16(r.ReadUvarint())
+	if d.Fields&PlayerFieldPosition != 0 {
+		state.X = int32(r.ReadVarint())
+		state.Y = int32(r.ReadVarint())
+	}
+	if d.Fields&PlayerFieldRotation != 0 {
+		state.Rotation = r.ReadUint16()
+	}
+	if d.Fields&PlayerFieldWeapon != 0 {
+		state.Weapon = WeaponType(r.ReadUvarint())
+	}
+	if d.Fields&PlayerFieldRoll != 0 {
+		state.IsRolling = r.ReadBool()
+		state.RollDuration = r.ReadFloat()
+		state.RollCooldown = r.ReadFloat()
+	}
+	if d.Fields&PlayerFieldReady != 0 {
+		state.IsReady = r.ReadBool()
+	}
+	if d.Fields&PlayerFieldLife != 0 {
+		state.Life = int(r.ReadVarint())
+	}
+	if d.Fields&PlayerFieldDeadPosition != 0 {
+		state.DeadX = int32(r.ReadVarint())
+		state.DeadY = int32(r.ReadVarint())
+	}
+	if d.Fields&PlayerFieldRTT != 0 {
+		state.RTT = uint32(r.ReadUvarint())
+	}
+	if d.Fields&PlayerFieldLastInput != 0 {
+		state.LastInput = uint32(r.ReadUvarint())
+	}
+}
+
+func (d PlayerSnapshotData) EncodeBinary(w *BinaryWriter) {
+	w.WriteUvarint(uint64(d.Sequence))
+	w.WriteUvarint(uint64(d.Baseline))
+	w.WriteUvarint(uint64(len(d.Players)))
+	for _, delta := range d.Players {
+		delta.EncodeBinary(w)
+	}
+	w.WriteUvarint(uint64(len(d.Removed)))
+	for _, id := range d.Removed {
+		w.WriteUvarint(uint64(id))
+	}
+}
+
+func (d *PlayerSnapshotData) DecodeBinary(r *BinaryReader) {
+	d.Sequence = uint32(r.ReadUvarint())
+	d.Baseline = uint32(r.ReadUvarint())
+	d.Players = make([]PlayerDelta, r.ReadCount(2))
+	for i := range d.Players {
+		d.Players[i].DecodeBinary(r)
+	}
+	d.Removed = make([]uint, r.ReadCount(1))
+	for i := range d.Removed {
+		d.Removed[i] = uint(r.ReadUvarint())
+	}
+}
+
+func (h HitInfo) EncodeBinary(w *BinaryWriter) {
+	w.WriteUvarint(uint64(h.PlayerID))
+	w.WriteVarint(int64(h.Damage))
+	w.WriteVarint(int64(h.Life))
+}
+
+func (h *HitInfo) DecodeBinary(r *BinaryReader) {
+	h.PlayerID = uint(r.ReadUvarint())
+	h.Damage = int(r.ReadVarint())
+	h.Life = int(r.ReadVarint())
+}
+
+func (d PlayerUpdateData) EncodeBinary(w *BinaryWriter) {
+	w.WriteUvarint(uint64(len(d.Inputs)))
+	for _, input := range d.Inputs {
+		input.EncodeBinary(w)
+	}
+	w.WriteFloat(d.Rotation)
+	w.WriteUvarint(uint64(d.Weapon))
+	w.WriteUvarint(uint64(d.SnapshotAck))
+}
+
+func (d *PlayerUpdateData) DecodeBinary(r *BinaryReader) {
+	d.Inputs = make([]PlayerInput, r.ReadCount(2))
+	for i := range d.Inputs {
+		d.Inputs[i].DecodeBinary(r)
+	}
+	d.Rotation = r.ReadFloat()
+	d.Weapon = WeaponType(r.ReadUvarint())
+	d.SnapshotAck = uint32(r.ReadUvarint())
+}
+
+// the keys are packed into a single byte, inputs are sent a lot
+func (i PlayerInput) EncodeBinary(w *BinaryWriter) {
+	w.WriteUvarint(uint64(i.Sequence))
+	var keys uint8
+	for bit, pressed := range []bool{i.Up, i.Down, i.Left, i.Right, i.Roll} {
+		if pressed {
+			keys |= 1 << bit
+		}
+	}
+	w.WriteUint8(keys)
+}
+
+func (i *PlayerInput) DecodeBinary(r *BinaryReader) {
+	i.Sequence = uint32(r.ReadUvarint())
+	keys := r.ReadUint8()
+	i.Up = keys&(1<<0) != 0
+	i.Down = keys&(1<<1) != 0
+	i.Left = keys&(1<<2) != 0
+	i.Right = keys&(1<<3) != 0
+	i.Roll = keys&(1<<4) != 0
+}
+
+func (b Bullet) EncodeBinary(w *BinaryWriter) {
+	w.WritePosition(b.Position)
+	w.WriteFloat(b.Rotation)
+	w.WriteUvarint(uint64(b.WeaponType))
+	w.WriteFloat(float64(b.Speed))
+	w.WriteFloat(b.GracePeriod)
+	w.WriteBool(b.HurtsPlayer)
+	w.WriteVarint(b.ViewTime)
+}
+
+func (b *Bullet) DecodeBinary(r *BinaryReader) {
+	b.Position = r.ReadPosition()
+	b.Rotation = r.ReadFloat()
+	b.WeaponType = WeaponType(r.ReadUvarint())
+	b.Speed = float32(r.ReadFloat())
+	b.GracePeriod = r.ReadFloat()
+	b.HurtsPlayer = r.ReadBool()
+	b.ViewTime = r.ReadVarint()
+}
+
+func (m Modifier) EncodeBinary(w *BinaryWriter) {
+	w.WriteVarint(int64(m.CalcType))
+	w.WriteVarint(int64(m.Type))
+	w.WriteFloat(m.Value)
+}
+
+func (m *Modifier) DecodeBinary(r *BinaryReader) {
+	m.CalcType = ModifierCalcType(r.ReadVarint())
+	m.Type = ModifierType(r.ReadVarint())
+	m.Value = r.ReadFloat()
+}
+
+func encodeModifierList(w *BinaryWriter, modifiers []Modifier) {
+	w.WriteUvarint(uint64(len(modifiers)))
+	for _, m := range modifiers {
+		m.EncodeBinary(w)
+	}
+}
+
+func decodeModifierList(r *BinaryReader) []Modifier {
+	// a modifier is at least 2 varints and a float
+	modifiers := make([]Modifier, r.ReadCount(6))
+	for i := range modifiers {
+		modifiers[i].DecodeBinary(r)
+	}
+	return modifiers
+}
+
+func (m Modifiers) EncodeBinary(w *BinaryWriter) {
+	encodeModifierList(w, m.Monster)
+	encodeModifierList(w, m.Player)
+}
+
+func (m *Modifiers) DecodeBinary(r *BinaryReader) {
+	m.Monster = decodeModifierList(r)
+	m.Player = decodeModifierList(r)
+}
+
+func encodeModifiersOptions(w *BinaryWriter, options []Modifiers) {
+	w.WriteUvarint(uint64(len(options)))
+	for _, m := range options {
+		m.EncodeBinary(w)
+	}
+}
+
+func decodeModifiersOptions(r *BinaryReader) []Modifiers {
+	options := make([]Modifiers, r.ReadCount(2))
+	for i := range options {
+		options[i].DecodeBinary(r)
+	}
+	return options
+}
+
+func (s ServerState) EncodeBinary(w *BinaryWriter) {
+	w.WriteUvarint(uint64(s.State))
+	w.WriteVarint(s.Context.Time.UnixMilli())
+	w.WriteUvarint(uint64(s.Context.Level))
+	encodeModifiersOptions(w, s.Context.ModifiersOptions)
+	w.WriteBool(s.Context.HasChosenOptions)
+	w.WriteVarint(s.Seed)
+}
+
+func (s *ServerState) DecodeBinary(r *BinaryReader) {
+	s.State = ServerStateType(r.ReadUvarint())
+	s.Context.Time = time.UnixMilli(r.ReadVarint())
+	s.Context.Level = r.ReadLevel()
+	s.Context.ModifiersOptions = decodeModifiersOptions(r)
+	s.Context.HasChosenOptions = r.ReadBool()
+	s.Seed = r.ReadVarint()
+}
+
+func (e Enemy) EncodeBinary(w *BinaryWriter) {
+	w.WriteUvarint(uint64(e.ID))
+	w.WriteUvarint(uint64(e.Type))
+	w.WritePosition(e.Position)
+	w.WriteVarint(int64(e.MoveDuration))
+	w.WriteUvarint(uint64(e.Lifetime))
+	w.WriteVarint(int64(e.Life))
+	w.WriteUvarint(uint64(e.Target))
+	w.WriteUvarint(uint64(len(e.Path)))
+	for _, p := range e.Path {
+		w.WritePosition(p)
+	}
+	w.WriteFloat(e.Speed)
+}
+
+func (e *Enemy) DecodeBinary(r *BinaryReader) {
+	e.ID = uint(r.ReadUvarint())
+	e.Type = CharacterType(r.ReadUvarint())
+	e.Position = r.ReadPosition()
+	e.MoveDuration = int(r.ReadVarint())
+	e.Lifetime = uint(r.ReadUvarint())
+	e.Life = int(r.ReadVarint())
+	e.Target = uint(r.ReadUvarint())
+	e.Path = make([]Position, r.ReadCount(8))
+	for i := range e.Path {
+		e.Path[i] = r.ReadPosition()
+	}
+	e.Speed = r.ReadFloat()
+}
+
+func (e EnemySnapshot) EncodeBinary(w *BinaryWriter) {
+	w.WriteUvarint(uint64(e.ID))
+	w.WriteUvarint(uint64(e.Type))
+	w.WritePosition(e.Position)
+	w.WriteVarint(int64(e.Life))
+	w.WriteUvarint(uint64(e.Target))
+	w.WriteUvarint(uint64(e.Lifetime))
+}
+
+func (e *EnemySnapshot) DecodeBinary(r *BinaryReader) {
+	e.ID = uint(r.ReadUvarint())
+	e.Type = CharacterType(r.ReadUvarint())
+	e.Position = r.ReadPosition()
+	e.Life = int(r.ReadVarint())
+	e.Target = uint(r.ReadUvarint())
+	e.Lifetime = uint(r.ReadUvarint())
+}
+
+func (d EnemySnapshotData) EncodeBinary(w *BinaryWriter) {
+	w.WriteUvarint(uint64(len(d.Enemies)))
+	for _, enemy := range d.Enemies {
+		enemy.EncodeBinary(w)
+	}
+}
+
+func (d *EnemySnapshotData) DecodeBinary(r *BinaryReader) {
+	d.Enemies = make([]EnemySnapshot, r.ReadCount(8))
+	for i := range d.Enemies {
+		d.Enemies[i].DecodeBinary(r)
+	}
+}
+
+func (e Event) EncodeBinary(w *BinaryWriter) {
+	w.WriteUvarint(uint64(e.Type))
+	w.WriteUvarint(uint64(len(e.Enemies)))
+	for _, enemy := range e.Enemies {
+		enemy.EncodeBinary(w)
+	}
+	w.WriteUvarint(uint64(len(e.EnemyIDs)))
+	for _, id := range e.EnemyIDs {
+		w.WriteUvarint(uint64(id))
+	}
+	w.WriteUvarint(uint64(e.Level))
+	encodeModifiersOptions(w, e.Modifiers)
+	e.Player.EncodeBinary(w)
+}
+
+func (e *Event) DecodeBinary(r *BinaryReader) {
+	e.Type = EventType(r.ReadUvarint())
+	e.Enemies = make([]Enemy, r.ReadCount(8))
+	for i := range e.Enemies {
+		e.Enemies[i].DecodeBinary(r)
+	}
+	e.EnemyIDs = make([]uint, r.ReadCount(1))
+	for i := range e.EnemyIDs {
+		e.EnemyIDs[i] = uint(r.ReadUvarint())
+	}
+	e.Level = r.ReadLevel()
+	e.Modifiers = decodeModifiersOptions(r)
+	e.Player.DecodeBinary(r)
+}
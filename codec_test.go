@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type codecCase struct {
+	name  string
+	value BinaryEncoder
+	// an empty value of the same type to decode into
+	empty func() BinaryDecoder
+}
+
+func testAddr(i int) net.UDPAddr {
+	return net.UDPAddr{IP: net.IP{203, 0, 113, byte(i)}, Port: 40000 + i}
+}
+
+func testPlayer(id uint) ConnectedPlayer {
+	return ConnectedPlayer{
+		Addr:           testAddr(int(id)),
+		Position:       Position{float64(id) * 31.5, 200.25},
+		Rotation:       1.25,
+		Weapon:         WeaponRevolver,
+		IsRolling:      true,
+		IsReady:        true,
+		TimeLastPacket: 1700000000000,
+		Life:           PLAYER_LIFE - 1,
+		DeadPosition:   Position{-4, 8},
+		ID:             id,
+		RTT:            87,
+		LastInput:      1234,
+		RollDuration:   0.5,
+		RollCooldown:   0.75,
+	}
+}
+
+func testEnemy(id uint) Enemy {
+	return Enemy{
+		ID:           id,
+		Type:         CharacterZombie,
+		Position:     Position{float64(id) * 16, 320.5},
+		MoveDuration: 3,
+		Lifetime:     120,
+		Life:         -2,
+		Target:       2,
+		Path:         []Position{{1, 2}, {3.5, 4.5}},
+		Speed:        1.5,
+	}
+}
+
+func testModifiers() []Modifiers {
+	return []Modifiers{
+		{
+			Monster: []Modifier{{ModifierCalcTypeMulti, ModifierTypeSpeed, 0.125}},
+			Player:  []Modifier{{ModifierCalcTypeAddi, ModifierTypeDamage, 0.25}, {ModifierCalcTypeMulti, ModifierTypeLife, -0.5}},
+		},
+		{
+			Monster: []Modifier{},
+			Player:  []Modifier{{ModifierCalcTypeAddi, ModifierTypeWeaponCooldown, 0.375}},
+		},
+	}
+}
+
+func testEnemies(count int) []Enemy {
+	enemies := make([]Enemy, count)
+	for i := range enemies {
+		enemies[i] = testEnemy(uint(i + 1))
+	}
+	return enemies
+}
+
+func testEnemySnapshots(count int) EnemySnapshotData {
+	data := EnemySnapshotData{make([]EnemySnapshot, count)}
+	for i := range data.Enemies {
+		data.Enemies[i] = testEnemy(uint(i + 1)).Snapshot()
+	}
+	return data
+}
+
+// testPayloads has one filled in value of every payload we send. Slices are never nil as decoding
+// always hands back a non nil one, and floats fit in a float32 as that is what goes over the wire
+func testPayloads() []codecCase {
+	return []codecCase{
+		{"ReconcilliationData", ReconcilliationData{"JOINABCD"}, func() BinaryDecoder { return &ReconcilliationData{} }},
+		{"ErrorData", NewVersionMismatchError(3), func() BinaryDecoder { return &ErrorData{} }},
+		{"RelayData", RelayData{testAddr(9), []byte{1, 2, 3, 4}}, func() BinaryDecoder { return &RelayData{} }},
+		{"AckData", AckData{0xdeadbeef}, func() BinaryDecoder { return &AckData{} }},
+		{"FragmentData", FragmentData{7, 2, 5, []byte("chunk")}, func() BinaryDecoder { return &FragmentData{} }},
+		{"PingData", PingData{1700000000123, -250, 90}, func() BinaryDecoder { return &PingData{} }},
+		{"PongData", PongData{1700000000123, 1700000000200, 1700000000201}, func() BinaryDecoder { return &PongData{} }},
+		{"HostMetadata", HostMetadata{"host", 3, 2, LevelTwo}, func() BinaryDecoder { return &HostMetadata{} }},
+		{"LobbyInfo", LobbyInfo{"ABCD", "host", 3, 1, LevelOne, PROTOCOL_VERSION}, func() BinaryDecoder { return &LobbyInfo{} }},
+		{"LobbyListData", LobbyListData{[]LobbyInfo{{"ABCD", "host", 3, 1, LevelOne, PROTOCOL_VERSION}, {"EFGH", "", 0, 0, LobbyLevel, 1}}}, func() BinaryDecoder { return &LobbyListData{} }},
+		{"LanAnnounceData", LanAnnounceData{"ABCD", 4, true}, func() BinaryDecoder { return &LanAnnounceData{} }},
+		{"ServerStateData", ServerStateData{LevelThree, time.UnixMilli(1700000000123)}, func() BinaryDecoder { return &ServerStateData{} }},
+		{"CoordinateData", CoordinateData{1.5, -2.25}, func() BinaryDecoder { return &CoordinateData{} }},
+		{"NegotiationRequest", NegotiationRequest{"player", 42}, func() BinaryDecoder { return &NegotiationRequest{} }},
+		{"NegotiationResponse", NegotiationResponse{testAddr(3), 3, 99, true, -12345}, func() BinaryDecoder { return &NegotiationResponse{} }},
+		{"ConnectedPlayer", testPlayer(5), func() BinaryDecoder { return &ConnectedPlayer{} }},
+		{"PlayerSnapshotData", PlayerSnapshotData{
+			12, 9,
+			[]PlayerDelta{
+				{PlayerFieldAll, PlayerSnapshot{1, 100, -200, 65535, WeaponGun, true, 0.5, 0.25, true, 3, 7, -7, 80, 1000}},
+				{PlayerFieldPosition | PlayerFieldRTT, PlayerSnapshot{ID: 2, X: 5, Y: 6, RTT: 40}},
+			},
+			[]uint{3, 4},
+		}, func() BinaryDecoder { return &PlayerSnapshotData{} }},
+		{"HitInfo", HitInfo{2, 1, PLAYER_LIFE - 1}, func() BinaryDecoder { return &HitInfo{} }},
+		{"PlayerUpdateData", PlayerUpdateData{[]PlayerInput{{10, true, false, true, false, false}, {11, false, true, false, true, true}}, 2.5, WeaponBow, 77}, func() BinaryDecoder { return &PlayerUpdateData{} }},
+		{"PlayerInput", PlayerInput{12, true, true, false, false, true}, func() BinaryDecoder { return &PlayerInput{} }},
+		{"Bullet", Bullet{Position{10, 20}, 0.5, WeaponRevolver, 4.5, 0.0625, true, 1700000000456, 0}, func() BinaryDecoder { return &Bullet{} }},
+		{"Modifiers", testModifiers()[0], func() BinaryDecoder { return &Modifiers{} }},
+		{"ServerState", ServerState{ServerStateShopping, ServerStateContext{time.UnixMilli(1700000000789), LevelFour, testModifiers(), true}, 2024}, func() BinaryDecoder { return &ServerState{} }},
+		{"Enemy", testEnemy(8), func() BinaryDecoder { return &Enemy{} }},
+		{"EnemySnapshotData", testEnemySnapshots(3), func() BinaryDecoder { return &EnemySnapshotData{} }},
+		{"Event", Event{SpawnEnemiesEvent, testEnemies(3), []uint{4, 5}, LevelOne, testModifiers(), testPlayer(1)}, func() BinaryDecoder { return &Event{} }},
+	}
+}
+
+func encodeTest(t testing.TB, value any) []byte {
+	t.Helper()
+	w := BinaryWriter{}
+	err := encodePayload(&w, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w.Bytes()
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, c := range testPayloads() {
+		t.Run(c.name, func(t *testing.T) {
+			data := encodeTest(t, c.value)
+
+			decoded := c.empty()
+			err := NewDecoder(data).Decode(decoded)
+			if err != nil {
+				t.Fatalf("decoding: %v", err)
+			}
+
+			got := reflect.ValueOf(decoded).Elem().Interface()
+			if !reflect.DeepEqual(got, c.value) {
+				t.Errorf("got %+v, want %+v", got, c.value)
+			}
+			if again := encodeTest(t, got); !bytes.Equal(again, data) {
+				t.Errorf("encoded again as %x, first time as %x", again, data)
+			}
+		})
+	}
+}
+
+func TestCodecRoundTripNonStructs(t *testing.T) {
+	id := uint(1 << 40)
+	var got_id uint
+	err := NewDecoder(encodeTest(t, id)).Decode(&got_id)
+	if err != nil || got_id != id {
+		t.Errorf("uint: got %d, %v", got_id, err)
+	}
+
+	addr := testAddr(1)
+	var got_addr net.UDPAddr
+	err = NewDecoder(encodeTest(t, addr)).Decode(&got_addr)
+	if err != nil || !reflect.DeepEqual(got_addr, addr) {
+		t.Errorf("address: got %v, %v", got_addr, err)
+	}
+
+	ipv6 := net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 9000, Zone: "eth0"}
+	err = NewDecoder(encodeTest(t, ipv6)).Decode(&got_addr)
+	if err != nil || got_addr.String() != ipv6.String() {
+		t.Errorf("ipv6 address: got %v, %v", got_addr, err)
+	}
+
+	players := []ConnectedPlayer{testPlayer(1), testPlayer(2), testPlayer(3)}
+	var got_players []ConnectedPlayer
+	err = NewDecoder(encodeTest(t, players)).Decode(&got_players)
+	if err != nil || !reflect.DeepEqual(got_players, players) {
+		t.Errorf("players: got %+v, %v", got_players, err)
+	}
+}
+
+func TestCodecTruncated(t *testing.T) {
+	for _, c := range testPayloads() {
+		data := encodeTest(t, c.value)
+		// every prefix is missing something, the decoder has to say so instead of making it up
+		for n := 0; n < len(data); n++ {
+			err := NewDecoder(data[:n]).Decode(c.empty())
+			if err == nil {
+				t.Errorf("%s: decoded %d of %d bytes without an error", c.name, n, len(data))
+				break
+			}
+		}
+	}
+}
+
+func TestCodecRejectsUnknownLevel(t *testing.T) {
+	w := BinaryWriter{}
+	HostMetadata{"host", 1, 0, LevelCount}.EncodeBinary(&w)
+
+	err := NewDecoder(w.Bytes()).Decode(&HostMetadata{})
+	if !errors.Is(err, ErrInvalidPayload) {
+		t.Errorf("got %v, want %v", err, ErrInvalidPayload)
+	}
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	event := Event{EnemyDiedEvent, []Enemy{}, []uint{1, 2, 3}, LevelTwo, []Modifiers{}, testPlayer(2)}
+	packet := Packet{PacketType: PacketTypeServerEvent, Sequence: 17, SessionToken: 1 << 60}
+
+	raw, err := SerializePacket(packet, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, data, err := DeserializePacket(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.PacketType != packet.PacketType || got.Sequence != packet.Sequence || got.SessionToken != packet.SessionToken || got.Version != PROTOCOL_VERSION {
+		t.Errorf("got header %+v", got)
+	}
+
+	got_event := Event{}
+	err = NewDecoder(data).Decode(&got_event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got_event, event) {
+		t.Errorf("got %+v, want %+v", got_event, event)
+	}
+}
+
+// payloads that are sent the most or are the largest, gob can't encode enemies as they keep snapshots
+func benchmarkPayloads() []codecCase {
+	players := []ConnectedPlayer{testPlayer(1), testPlayer(2), testPlayer(3), testPlayer(4)}
+	inputs := make([]PlayerInput, 6)
+	for i := range inputs {
+		inputs[i] = PlayerInput{uint32(100 + i), true, false, i%2 == 0, false, false}
+	}
+
+	return []codecCase{
+		{"PlayerUpdateData", PlayerUpdateData{inputs, 1.5, WeaponBow, 300}, func() BinaryDecoder { return &PlayerUpdateData{} }},
+		{"EnemySnapshotData", testEnemySnapshots(50), func() BinaryDecoder { return &EnemySnapshotData{} }},
+		{"ServerState", ServerState{ServerStateShopping, ServerStateContext{time.UnixMilli(1700000000789), LevelFour, testModifiers(), false}, 2024}, func() BinaryDecoder { return &ServerState{} }},
+		{"Players", playerList(players), func() BinaryDecoder { return &playerList{} }},
+	}
+}
+
+// playerList lets the player list sit in a codecCase next to the other payloads
+type playerList []ConnectedPlayer
+
+func (l playerList) EncodeBinary(w *BinaryWriter) {
+	encodePayload(w, []ConnectedPlayer(l))
+}
+
+func (l *playerList) DecodeBinary(r *BinaryReader) {
+	(&Decoder{r}).Decode((*[]ConnectedPlayer)(l))
+}
+
+// BenchmarkCodec encodes and decodes every payload once per op, with our encoding and with gob the way
+// every packet used to be sent, a fresh encoder each time
+func BenchmarkCodec(b *testing.B) {
+	for _, c := range benchmarkPayloads() {
+		b.Run(fmt.Sprintf("%s/binary", c.name), func(b *testing.B) {
+			b.ReportAllocs()
+			size := 0
+			for i := 0; i < b.N; i++ {
+				w := BinaryWriter{}
+				c.value.EncodeBinary(&w)
+				size = len(w.Bytes())
+
+				r := NewBinaryReader(w.Bytes())
+				c.empty().DecodeBinary(r)
+				if r.Err() != nil {
+					b.Fatal(r.Err())
+				}
+			}
+			b.ReportMetric(float64(size), "bytes/op")
+		})
+
+		b.Run(fmt.Sprintf("%s/gob", c.name), func(b *testing.B) {
+			b.ReportAllocs()
+			size := 0
+			for i := 0; i < b.N; i++ {
+				var buf bytes.Buffer
+				err := gob.NewEncoder(&buf).Encode(c.value)
+				if err != nil {
+					b.Fatal(err)
+				}
+				size = buf.Len()
+
+				err = gob.NewDecoder(&buf).Decode(c.empty())
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(size), "bytes/op")
+		})
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+)
+
+const DEFAULT_CONFIG_PATH = "config.json"
+const DEFAULT_MEDIATION_ADDR = "84.215.22.166"
+const DEFAULT_ADMIN_ADDR = "127.0.0.1:8090"
+
+// Config decides where we find the mediation server and where we listen ourselves.
+// Later sources win: the defaults, then the config file, then GMTK_* environment variables, then flags
+type Config struct {
+	// host name or ip of the mediation server
+	MediationAddr string `json:"mediation_addr"`
+	MediationPort int    `json:"mediation_port"`
+	// port the game server listens on, and the one the local client of a host talks to
+	ServerPort int `json:"server_port"`
+	// interface the game and mediation servers listen on, empty means all of them
+	BindAddr string `json:"bind_addr"`
+	// port hosts broadcast their games to on the local network
+	LanPort int `json:"lan_port"`
+	// what our lobby is called in the public lobby list
+	HostName string `json:"host_name"`
+	// whether the mediation server passes packets along for players that can't punch through to their host
+	Relay bool `json:"relay"`
+	// where the mediation server serves its stats, empty turns it off. Keep it on localhost
+	AdminAddr string `json:"admin_addr"`
+	// "text" or "json", only used by the mediation server
+	LogFormat string `json:"log_format"`
+	// how far in the past remote players and enemies are shown, and how long they keep
+	// moving on their own when updates stop coming, both in ms
+	InterpolationDelayMs int `json:"interpolation_delay_ms"`
+	ExtrapolationLimitMs int `json:"extrapolation_limit_ms"`
+	// in pixels, players further apart than this don't get each other's movement, 0 sends everyone everything
+	InterestRadius int `json:"interest_radius"`
+	// makes the network worse on purpose to reproduce lag related bugs, see NetConditions
+	SimLatencyMs   int     `json:"sim_latency_ms"`
+	SimJitterMs    int     `json:"sim_jitter_ms"`
+	SimLoss        float64 `json:"sim_loss"`
+	SimDuplication float64 `json:"sim_duplication"`
+	SimSeed        int     `json:"sim_seed"`
+	// every run a server hosts plays the same with the same seed and inputs, 0 picks a new one every run
+	Seed int `json:"seed"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		MediationAddr: DEFAULT_MEDIATION_ADDR,
+		MediationPort: MEDIATION_SERVERPORT,
+		ServerPort:    SERVERPORT,
+		BindAddr:      "",
+		LanPort:       LAN_DISCOVERY_PORT,
+		HostName:      DefaultHostName(),
+		Relay:         true,
+		AdminAddr:     DEFAULT_ADMIN_ADDR,
+		LogFormat:     "text",
+
+		InterpolationDelayMs: DEFAULT_INTERPOLATION_DELAY_MS,
+		ExtrapolationLimitMs: DEFAULT_EXTRAPOLATION_LIMIT_MS,
+	}
+}
+
+// LoadConfigFile overrides whatever the file sets, a missing file is not an error
+func (c *Config) LoadConfigFile(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(data, c)
+	if err != nil {
+		return fmt.Errorf("error reading config %s: %w", path, err)
+	}
+	return nil
+}
+
+func (c *Config) LoadEnv() error {
+	if value, ok := os.LookupEnv("GMTK_MEDIATION_ADDR"); ok {
+		c.MediationAddr = value
+	}
+	if value, ok := os.LookupEnv("GMTK_BIND_ADDR"); ok {
+		c.BindAddr = value
+	}
+	if value, ok := os.LookupEnv("GMTK_HOST_NAME"); ok {
+		c.HostName = value
+	}
+	if value, ok := os.LookupEnv("GMTK_ADMIN_ADDR"); ok {
+		c.AdminAddr = value
+	}
+	if value, ok := os.LookupEnv("GMTK_LOG_FORMAT"); ok {
+		c.LogFormat = value
+	}
+	if value, ok := os.LookupEnv("GMTK_RELAY"); ok {
+		relay, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("GMTK_RELAY is not a boolean: %w", err)
+		}
+		c.Relay = relay
+	}
+
+	numbers := map[string]*int{
+		"GMTK_MEDIATION_PORT":         &c.MediationPort,
+		"GMTK_SERVER_PORT":            &c.ServerPort,
+		"GMTK_LAN_PORT":               &c.LanPort,
+		"GMTK_INTERPOLATION_DELAY_MS": &c.InterpolationDelayMs,
+		"GMTK_EXTRAPOLATION_LIMIT_MS": &c.ExtrapolationLimitMs,
+		"GMTK_INTEREST_RADIUS":        &c.InterestRadius,
+		"GMTK_SIM_LATENCY_MS":         &c.SimLatencyMs,
+		"GMTK_SIM_JITTER_MS":          &c.SimJitterMs,
+		"GMTK_SIM_SEED":               &c.SimSeed,
+		"GMTK_SEED":                   &c.Seed,
+	}
+	for name, number := range numbers {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s is not a number: %w", name, err)
+		}
+		*number = parsed
+	}
+
+	chances := map[string]*float64{
+		"GMTK_SIM_LOSS":        &c.SimLoss,
+		"GMTK_SIM_DUPLICATION": &c.SimDuplication,
+	}
+	for name, chance := range chances {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%s is not a number: %w", name, err)
+		}
+		*chance = parsed
+	}
+
+	return nil
+}
+
+// RegisterFlags adds the config flags to the flag set, ApplyFlags has to be called after parsing
+func (c *Config) RegisterFlags(flags *flag.FlagSet) *Config {
+	overrides := Config{}
+	flags.StringVar(&overrides.MediationAddr, "mediation", c.MediationAddr, "address of the mediation server")
+	flags.IntVar(&overrides.MediationPort, "mediation-port", c.MediationPort, "port of the mediation server")
+	flags.IntVar(&overrides.ServerPort, "port", c.ServerPort, "port the game server listens on")
+	flags.StringVar(&overrides.BindAddr, "bind", c.BindAddr, "interface the servers listen on, all of them if empty")
+	flags.IntVar(&overrides.LanPort, "lan-port", c.LanPort, "port games are announced on in the local network")
+	flags.StringVar(&overrides.HostName, "name", c.HostName, "name of our lobby in the public lobby list")
+	flags.BoolVar(&overrides.Relay, "relay", c.Relay, "let the mediation server relay for players that can't punch through")
+	flags.StringVar(&overrides.AdminAddr, "admin", c.AdminAddr, "where the mediation server serves its stats, off if empty")
+	flags.StringVar(&overrides.LogFormat, "log-format", c.LogFormat, "text or json logs for the mediation server")
+	flags.IntVar(&overrides.InterpolationDelayMs, "interp-delay", c.InterpolationDelayMs, "ms remote players and enemies are shown in the past")
+	flags.IntVar(&overrides.ExtrapolationLimitMs, "extrapolation-limit", c.ExtrapolationLimitMs, "ms remote players and enemies keep moving without updates")
+	flags.IntVar(&overrides.InterestRadius, "interest-radius", c.InterestRadius, "pixels beyond which players don't get each other's movement, off if 0")
+	flags.IntVar(&overrides.SimLatencyMs, "sim-latency", c.SimLatencyMs, "ms of latency added to everything we send and receive")
+	flags.IntVar(&overrides.SimJitterMs, "sim-jitter", c.SimJitterMs, "ms the simulated latency varies by either way")
+	flags.Float64Var(&overrides.SimLoss, "sim-loss", c.SimLoss, "chance from 0 to 1 of dropping a datagram")
+	flags.Float64Var(&overrides.SimDuplication, "sim-duplicate", c.SimDuplication, "chance from 0 to 1 of delivering a datagram twice")
+	flags.IntVar(&overrides.SimSeed, "sim-seed", c.SimSeed, "seed of the simulated network, the same seed misbehaves the same way")
+	flags.IntVar(&overrides.Seed, "seed", c.Seed, "seed every run we host is played with, a new one every run if 0")
+	return &overrides
+}
+
+// only flags that were actually passed override the config, so the file and environment keep working
+func (c *Config) ApplyFlags(flags *flag.FlagSet, overrides *Config) {
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "mediation":
+			c.MediationAddr = overrides.MediationAddr
+		case "mediation-port":
+			c.MediationPort = overrides.MediationPort
+		case "port":
+			c.ServerPort = overrides.ServerPort
+		case "bind":
+			c.BindAddr = overrides.BindAddr
+		case "lan-port":
+			c.LanPort = overrides.LanPort
+		case "name":
+			c.HostName = overrides.HostName
+		case "relay":
+			c.Relay = overrides.Relay
+		case "admin":
+			c.AdminAddr = overrides.AdminAddr
+		case "log-format":
+			c.LogFormat = overrides.LogFormat
+		case "interp-delay":
+			c.InterpolationDelayMs = overrides.InterpolationDelayMs
+		case "extrapolation-limit":
+			c.ExtrapolationLimitMs = overrides.ExtrapolationLimitMs
+		case "interest-radius":
+			c.InterestRadius = overrides.InterestRadius
+		case "sim-latency":
+			c.SimLatencyMs = overrides.SimLatencyMs
+		case "sim-jitter":
+			c.SimJitterMs = overrides.SimJitterMs
+		case "sim-loss":
+			c.SimLoss = overrides.SimLoss
+		case "sim-duplicate":
+			c.SimDuplication = overrides.SimDuplication
+		case "sim-seed":
+			c.SimSeed = overrides.SimSeed
+		case "seed":
+			c.Seed = overrides.Seed
+		}
+	})
+}
+
+func (c Config) Validate() error {
+	for _, port := range []int{c.MediationPort, c.ServerPort, c.LanPort} {
+		if port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid port %d", port)
+		}
+	}
+	if c.BindAddr != "" && net.ParseIP(c.BindAddr) == nil {
+		return fmt.Errorf("bind address %s is not an ip", c.BindAddr)
+	}
+	if c.AdminAddr != "" {
+		if _, _, err := net.SplitHostPort(c.AdminAddr); err != nil {
+			return fmt.Errorf("admin address %s: %w", c.AdminAddr, err)
+		}
+	}
+	if c.InterpolationDelayMs < 0 || c.ExtrapolationLimitMs < 0 {
+		return fmt.Errorf("interpolation delay and extrapolation limit can't be negative")
+	}
+	if c.InterestRadius < 0 {
+		return fmt.Errorf("interest radius can't be negative")
+	}
+	if c.SimLatencyMs < 0 || c.SimJitterMs < 0 {
+		return fmt.Errorf("simulated latency and jitter can't be negative")
+	}
+	if c.SimLoss < 0 || c.SimLoss > 1 || c.SimDuplication < 0 || c.SimDuplication > 1 {
+		return fmt.Errorf("simulated loss and duplication are chances from 0 to 1")
+	}
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		return fmt.Errorf("log format has to be text or json, not %s", c.LogFormat)
+	}
+	return nil
+}
+
+func (c Config) NetConditions() NetConditions {
+	return NetConditions{c.SimLatencyMs, c.SimJitterMs, c.SimLoss, c.SimDuplication, int64(c.SimSeed)}
+}
+
+func (c Config) ResolveMediationAddr() (*net.UDPAddr, error) {
+	return net.ResolveUDPAddr("udp", net.JoinHostPort(c.MediationAddr, strconv.Itoa(c.MediationPort)))
+}
+
+func (c Config) ServerListenAddr() *net.UDPAddr {
+	return &net.UDPAddr{IP: net.ParseIP(c.BindAddr), Port: c.ServerPort}
+}
+
+func (c Config) MediationListenAddr() *net.UDPAddr {
+	return &net.UDPAddr{IP: net.ParseIP(c.BindAddr), Port: c.MediationPort}
+}
+
+// where the local client of a host finds its server
+func (c Config) LocalServerAddr() net.UDPAddr {
+	ip := net.ParseIP(c.BindAddr)
+	if ip == nil || ip.IsUnspecified() {
+		ip = net.ParseIP("127.0.0.1")
+	}
+	return net.UDPAddr{IP: ip, Port: c.ServerPort}
+}
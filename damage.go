@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+)
+
+const (
+	// how far a bullet may start from where we have its shooter, the shooter is a little ahead of us
+	MAX_SHOT_DISTANCE = TILE_SIZE * 4
+	// shots a player may have saved up, bullets sent a cooldown apart can arrive closer together than that
+	MAX_SHOT_BURST = 2
+)
+
+// updatePlayer changes a player in s.connections. players_mutex keeps the packet loop
+// and Update from storing over each other's changes
+func (s *Server) updatePlayer(id uint, update func(player *ConnectedPlayer)) bool {
+	s.players_mutex.Lock()
+	defer s.players_mutex.Unlock()
+
+	player, ok := loadFromSyncMap[ConnectedPlayer](id, &s.connections)
+	if !ok {
+		return false
+	}
+	update(&player)
+	s.connections.Store(id, player)
+	return true
+}
+
+// ghosts, rolling players and players that were just hit can't be hurt
+func (p ConnectedPlayer) CanBeHit() bool {
+	return p.Life > 0 && !p.IsRolling && p.grace_period == 0
+}
+
+// DamagePlayer takes damage off a player's life if it can be hit and lets everyone know
+//
+// Note that calls of this method should happen from Server.Update
+func (s *Server) DamagePlayer(id uint, damage int) {
+	hit := false
+	hitInfo := HitInfo{}
+
+	s.updatePlayer(id, func(player *ConnectedPlayer) {
+		if !player.CanBeHit() {
+			return
+		}
+
+		player.Life = max(0, player.Life-damage)
+		player.grace_period = DEFAULT_GRACEPERIOD
+		if player.Life == 0 {
+			player.DeadPosition = player.Position
+		}
+
+		hit = true
+		hitInfo = HitInfo{player.ID, damage, player.Life}
+	})
+
+	if hit {
+		packet := Packet{}
+		packet.PacketType = PacketTypePlayerHit
+		s.Broadcast(packet, hitInfo)
+	}
+}
+
+// CheckEnemyContact hurts everyone an enemy has caught up with
+//
+// Note that calls of this method should happen from Server.Update
+func (s *Server) CheckEnemyContact() {
+	for _, player := range s.GetAlivePlayers() {
+		if !player.CanBeHit() {
+			continue
+		}
+
+		for _, enemy := range s.Enemies {
+			if enemy.Position.X < player.Position.X+TILE_SIZE &&
+				enemy.Position.X+TILE_SIZE > player.Position.X &&
+				enemy.Position.Y < player.Position.Y+TILE_SIZE &&
+				enemy.Position.Y+TILE_SIZE > player.Position.Y {
+				s.DamagePlayer(player.ID, GetCharacterDamage(enemy.Type))
+				break
+			}
+		}
+	}
+}
+
+// TickGracePeriods counts down everyone's i-frames by dt seconds
+func (s *Server) TickGracePeriods(dt float64) {
+	s.connection_keys_mutex.RLock()
+	for _, conn := range s.connection_keys {
+		s.updatePlayer(conn, func(player *ConnectedPlayer) {
+			player.grace_period = max(0, player.grace_period-dt*COOLDOWN_UNITS_PER_SECOND)
+		})
+	}
+	s.connection_keys_mutex.RUnlock()
+}
+
+// RestoreLife gives everyone the life they start a level with, the players do the same on their end
+func (s *Server) RestoreLife() {
+	life := int(s.Modifiers.GetModifiedPlayerValue(ModifierTypeLife) * PLAYER_LIFE)
+
+	s.connection_keys_mutex.RLock()
+	for _, conn := range s.connection_keys {
+		s.updatePlayer(conn, func(player *ConnectedPlayer) {
+			player.Life = life
+			player.grace_period = 0
+		})
+	}
+	s.connection_keys_mutex.RUnlock()
+}
+
+// validateBullet makes a bullet a player shot follow the rules of its weapon, and refuses it
+// if the player couldn't have shot it. Every shot uses up some of the player's shot budget
+//
+// Note that calls of this method should happen from Server.handlePacket, through updatePlayer
+func (s *Server) validateBullet(player *ConnectedPlayer, bullet *Bullet) error {
+	if player.Life < 1 {
+		return fmt.Errorf("player %d shot while dead", player.ID)
+	}
+	// the weapon decides the damage, so it has to be the one we know the player is holding
+	if bullet.WeaponType != player.Weapon {
+		return fmt.Errorf("player %d shot weapon %d while holding %d", player.ID, bullet.WeaponType, player.Weapon)
+	}
+
+	// the budget fills up at the rate the weapon's cooldown lets the player shoot
+	now := NowMillis()
+	interval := GetWeaponCooldown(player.Weapon) / s.Modifiers.GetModifiedPlayerValue(ModifierTypeWeaponCooldown) / COOLDOWN_UNITS_PER_SECOND
+	if player.last_shot_time == 0 {
+		player.shot_budget = MAX_SHOT_BURST
+	} else {
+		player.shot_budget += float64(now-player.last_shot_time) / 1000 / interval
+		player.shot_budget = min(MAX_SHOT_BURST, player.shot_budget)
+	}
+	player.last_shot_time = now
+
+	if player.shot_budget < 1 {
+		return fmt.Errorf("player %d shot faster than its weapon allows", player.ID)
+	}
+	player.shot_budget--
+
+	if bullet.Position.Distance(player.Position) > MAX_SHOT_DISTANCE {
+		bullet.Position = player.Position
+	}
+	bullet.Speed = GetWeaponSpeed(bullet.WeaponType) * float32(s.Modifiers.GetModifiedPlayerValue(ModifierTypeBulletSpeed))
+	bullet.HurtsPlayer = GetWeaponFriendlyFire(bullet.WeaponType)
+	bullet.GracePeriod = 1.5
+	bullet.rewind = RewindFor(now, EstimateViewTime(now, player.RTT, s.interpolation_delay, bullet.ViewTime))
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// RunDedicatedServer hosts a game without a window or a local player
+func RunDedicatedServer(config Config, code string) {
+	if code == "" {
+		code = NewJoinCode()
+	}
+
+	server := Server{}
+	stop := make(chan struct{})
+	go server.Host(config, JOIN_KEY_PREFIX+code, stop)
+
+	fmt.Printf("dedicated server listening on port %d with join key %s\n", config.ServerPort, code)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	<-interrupt
+
+	fmt.Println("shutting down")
+	// saying goodbye before the socket closes
+	if server.ready.Load() {
+		server.Shutdown()
+	}
+	close(stop)
+}
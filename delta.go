@@ -0,0 +1,305 @@
+package main
+
+import (
+	"math"
+)
+
+const (
+	// positions are sent in 1/POSITION_PRECISION pixels, fine enough to stay under RECONCILE_EPSILON
+	POSITION_PRECISION = 64
+	// snapshots both ends remember to be deltas against, players that haven't acked
+	// any of them get a complete one
+	PLAYER_SNAPSHOT_HISTORY = 32
+)
+
+// which fields of a PlayerSnapshot a PlayerDelta carries
+const (
+	PlayerFieldPosition uint16 = 1 << iota
+	PlayerFieldRotation
+	PlayerFieldWeapon
+	// IsRolling, RollDuration and RollCooldown
+	PlayerFieldRoll
+	PlayerFieldReady
+	PlayerFieldLife
+	PlayerFieldDeadPosition
+	PlayerFieldRTT
+	PlayerFieldLastInput
+
+	PlayerFieldAll uint16 = 1<<iota - 1
+	// what players outside the interest radius don't get updates of
+	PlayerFieldMovement = PlayerFieldPosition | PlayerFieldRotation | PlayerFieldRoll
+)
+
+// PlayerSnapshot is what a player gets to know about another, quantised so both ends
+// agree on whether something changed
+type PlayerSnapshot struct {
+	ID           uint
+	X            int32
+	Y            int32
+	Rotation     uint16
+	Weapon       WeaponType
+	IsRolling    bool
+	RollDuration float64
+	RollCooldown float64
+	IsReady      bool
+	Life         int
+	DeadX        int32
+	DeadY        int32
+	RTT          uint32
+	LastInput    uint32
+}
+
+type PlayerDelta struct {
+	Fields uint16
+	State  PlayerSnapshot
+}
+
+// PlayerSnapshotData replaces the full player list every player used to be sent
+type PlayerSnapshotData struct {
+	Sequence uint32
+	// the snapshot this one is a delta against, 0 when it is complete
+	Baseline uint32
+	Players  []PlayerDelta
+	// players that left since the baseline
+	Removed []uint
+}
+
+func QuantizePosition(v float64) int32 {
+	return int32(math.Round(v * POSITION_PRECISION))
+}
+
+func DequantizePosition(v int32) float64 {
+	return float64(v) / POSITION_PRECISION
+}
+
+func QuantizeRotation(rotation float64) uint16 {
+	turns := rotation / (2 * math.Pi)
+	turns -= math.Floor(turns)
+	return uint16(int(math.Round(turns*65536)) % 65536)
+}
+
+func DequantizeRotation(rotation uint16) float64 {
+	return float64(rotation) / 65536 * 2 * math.Pi
+}
+
+// NewPlayerSnapshot quantises what viewer gets to see of player
+func NewPlayerSnapshot(player ConnectedPlayer, viewer uint) PlayerSnapshot {
+	snapshot := PlayerSnapshot{
+		player.ID,
+		QuantizePosition(player.Position.X),
+		QuantizePosition(player.Position.Y),
+		QuantizeRotation(player.Rotation),
+		player.Weapon,
+		player.IsRolling,
+		player.RollDuration,
+		player.RollCooldown,
+		player.IsReady,
+		player.Life,
+		QuantizePosition(player.DeadPosition.X),
+		QuantizePosition(player.DeadPosition.Y),
+		player.RTT,
+		player.LastInput,
+	}
+
+	// only the player itself replays its inputs, everyone else would just be sent them for nothing
+	if player.ID != viewer {
+		snapshot.RollCooldown = 0
+		snapshot.LastInput = 0
+	}
+	return snapshot
+}
+
+func (ps PlayerSnapshot) ConnectedPlayer() ConnectedPlayer {
+	player := ConnectedPlayer{}
+	player.ID = ps.ID
+	player.Position = Position{DequantizePosition(ps.X), DequantizePosition(ps.Y)}
+	player.Rotation = DequantizeRotation(ps.Rotation)
+	player.Weapon = ps.Weapon
+	player.IsRolling = ps.IsRolling
+	player.RollDuration = ps.RollDuration
+	player.RollCooldown = ps.RollCooldown
+	player.IsReady = ps.IsReady
+	player.Life = ps.Life
+	player.DeadPosition = Position{DequantizePosition(ps.DeadX), DequantizePosition(ps.DeadY)}
+	player.RTT = ps.RTT
+	player.LastInput = ps.LastInput
+	return player
+}
+
+// Diff returns the fields that differ between the two
+func (ps PlayerSnapshot) Diff(other PlayerSnapshot) uint16 {
+	var fields uint16
+	if ps.X != other.X || ps.Y != other.Y {
+		fields |= PlayerFieldPosition
+	}
+	if ps.Rotation != other.Rotation {
+		fields |= PlayerFieldRotation
+	}
+	if ps.Weapon != other.Weapon {
+		fields |= PlayerFieldWeapon
+	}
+	if ps.IsRolling != other.IsRolling || ps.RollDuration != other.RollDuration || ps.RollCooldown != other.RollCooldown {
+		fields |= PlayerFieldRoll
+	}
+	if ps.IsReady != other.IsReady {
+		fields |= PlayerFieldReady
+	}
+	if ps.Life != other.Life {
+		fields |= PlayerFieldLife
+	}
+	if ps.DeadX != other.DeadX || ps.DeadY != other.DeadY {
+		fields |= PlayerFieldDeadPosition
+	}
+	if ps.RTT != other.RTT {
+		fields |= PlayerFieldRTT
+	}
+	if ps.LastInput != other.LastInput {
+		fields |= PlayerFieldLastInput
+	}
+	return fields
+}
+
+// Apply returns the snapshot with the fields the delta carries replaced
+func (ps PlayerSnapshot) Apply(delta PlayerDelta) PlayerSnapshot {
+	state := delta.State
+	ps.ID = state.ID
+	if delta.Fields&PlayerFieldPosition != 0 {
+		ps.X, ps.Y = state.X, state.Y
+	}
+	if delta.Fields&PlayerFieldRotation != 0 {
+		ps.Rotation = state.Rotation
+	}
+	if delta.Fields&PlayerFieldWeapon != 0 {
+		ps.Weapon = state.Weapon
+	}
+	if delta.Fields&PlayerFieldRoll != 0 {
+		ps.IsRolling, ps.RollDuration, ps.RollCooldown = state.IsRolling, state.RollDuration, state.RollCooldown
+	}
+	if delta.Fields&PlayerFieldReady != 0 {
+		ps.IsReady = state.IsReady
+	}
+	if delta.Fields&PlayerFieldLife != 0 {
+		ps.Life = state.Life
+	}
+	if delta.Fields&PlayerFieldDeadPosition != 0 {
+		ps.DeadX, ps.DeadY = state.DeadX, state.DeadY
+	}
+	if delta.Fields&PlayerFieldRTT != 0 {
+		ps.RTT = state.RTT
+	}
+	if delta.Fields&PlayerFieldLastInput != 0 {
+		ps.LastInput = state.LastInput
+	}
+	return ps
+}
+
+// PlayerSnapshotHistory is what one end remembers of the snapshots a single player was sent.
+// The server builds deltas against the newest one the player has acked, the player keeps
+// the ones it applied so it has whichever one that is
+type PlayerSnapshotHistory struct {
+	snapshots map[uint32]map[uint]PlayerSnapshot
+	// on the server the newest snapshot the player has acked, on the player the newest it has applied
+	acked uint32
+}
+
+func (h *PlayerSnapshotHistory) Ack(sequence uint32) {
+	h.acked = max(h.acked, sequence)
+}
+
+func (h *PlayerSnapshotHistory) Acked() uint32 {
+	return h.acked
+}
+
+func (h *PlayerSnapshotHistory) store(sequence uint32, players map[uint]PlayerSnapshot) {
+	if h.snapshots == nil {
+		h.snapshots = make(map[uint32]map[uint]PlayerSnapshot)
+	}
+	h.snapshots[sequence] = players
+
+	for old := range h.snapshots {
+		if old+PLAYER_SNAPSHOT_HISTORY <= sequence {
+			delete(h.snapshots, old)
+		}
+	}
+}
+
+// Build makes the snapshot viewer is sent next. Players further than interestRadius from the
+// viewer keep their last position until they come closer, 0 sends everyone everything
+func (h *PlayerSnapshotHistory) Build(sequence uint32, players []ConnectedPlayer, viewer uint, interestRadius float64) PlayerSnapshotData {
+	data := PlayerSnapshotData{Sequence: sequence}
+
+	baseline, ok := h.snapshots[h.acked]
+	if ok && h.acked != 0 {
+		data.Baseline = h.acked
+	} else {
+		baseline = map[uint]PlayerSnapshot{}
+	}
+
+	var viewer_pos *Position
+	for i := range players {
+		if players[i].ID == viewer {
+			viewer_pos = &players[i].Position
+		}
+	}
+
+	current := make(map[uint]PlayerSnapshot, len(players))
+	for _, player := range players {
+		snapshot := NewPlayerSnapshot(player, viewer)
+
+		known, ok := baseline[player.ID]
+		fields := PlayerFieldAll
+		if ok {
+			fields = snapshot.Diff(known)
+			// the viewer isn't going to see them move anyway
+			if interestRadius > 0 && viewer_pos != nil && player.Position.Distance(*viewer_pos) > interestRadius {
+				fields &^= PlayerFieldMovement
+			}
+		}
+
+		if fields != 0 {
+			data.Players = append(data.Players, PlayerDelta{fields, snapshot})
+		}
+		current[player.ID] = known.Apply(PlayerDelta{fields, snapshot})
+	}
+
+	for id := range baseline {
+		if _, ok := current[id]; !ok {
+			data.Removed = append(data.Removed, id)
+		}
+	}
+
+	h.store(sequence, current)
+	return data
+}
+
+// Apply turns a snapshot back into every player we know about. It fails for snapshots
+// older than one we already have and ones whose baseline we no longer have
+func (h *PlayerSnapshotHistory) Apply(data PlayerSnapshotData) (map[uint]PlayerSnapshot, bool) {
+	if data.Sequence <= h.acked {
+		return nil, false
+	}
+
+	baseline := map[uint]PlayerSnapshot{}
+	if data.Baseline != 0 {
+		var ok bool
+		baseline, ok = h.snapshots[data.Baseline]
+		if !ok {
+			return nil, false
+		}
+	}
+
+	current := make(map[uint]PlayerSnapshot, len(baseline)+len(data.Players))
+	for id, snapshot := range baseline {
+		current[id] = snapshot
+	}
+	for _, delta := range data.Players {
+		current[delta.State.ID] = current[delta.State.ID].Apply(delta)
+	}
+	for _, id := range data.Removed {
+		delete(current, id)
+	}
+
+	h.store(data.Sequence, current)
+	h.Ack(data.Sequence)
+	return current, true
+}
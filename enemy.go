@@ -66,14 +66,21 @@ func GetCharacterSpeed(character CharacterType) float64 {
 }
 
 type Enemy struct {
+	// handed out by the server, this is how its updates find the enemy on the client
+	ID           uint
 	Type         CharacterType
 	Position     Position
 	MoveDuration int
 	Lifetime     uint
 	Life         int
-	Target       string
-	Path         []Position
-	Speed        float64
+	// id of the player it is chasing
+	Target uint
+	Path   []Position
+	Speed  float64
+
+	// where the enemy has been recently. On clients these are the server's updates,
+	// the server keeps its own for checking bullets, see RecordEnemyPositions
+	Snapshots SnapshotBuffer
 }
 
 // we are cheating here and introducing game to the render because we can't introduce it for the update
@@ -157,6 +164,19 @@ func (e *Enemy) Update() {
 	}
 }
 
+// Animate puts a client's copy of the enemy where the server has it, clients never move enemies themselves
+func (e *Enemy) Animate(position Position) {
+	e.Lifetime++
+
+	if e.Position == position {
+		e.MoveDuration = e.MoveDuration % 30
+		e.MoveDuration = max(0, e.MoveDuration-1)
+	} else {
+		e.MoveDuration += 1
+	}
+	e.Position = position
+}
+
 func (e *Enemy) FindPath(target Position, obstacles [][]bool) {
 	path := FindPath(e.Position, target, obstacles)
 	if path == nil {
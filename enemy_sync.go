@@ -0,0 +1,204 @@
+package main
+
+import (
+	"image/color"
+)
+
+const (
+	// the server sends where its enemies are every this many ticks
+	ENEMY_SYNC_INTERVAL_TICKS = 3
+	// updates waiting for the game to pick them up, older ones are dropped if it doesn't
+	MAX_QUEUED_ENEMY_UPDATES = 16
+)
+
+// what clients need to know about an enemy to draw it, the server does everything else
+type EnemySnapshot struct {
+	ID       uint
+	Type     CharacterType
+	Position Position
+	Life     int
+	Target   uint
+	Lifetime uint
+}
+
+// every enemy the server has, enemies that are missing are gone
+type EnemySnapshotData struct {
+	Enemies []EnemySnapshot
+}
+
+type enemyUpdate struct {
+	// server time the snapshot was taken at
+	time int64
+	data EnemySnapshotData
+}
+
+func (e Enemy) Snapshot() EnemySnapshot {
+	return EnemySnapshot{e.ID, e.Type, e.Position, e.Life, e.Target, e.Lifetime}
+}
+
+// Note that calls of this method should happen from Server.Update, which owns s.Enemies
+func (s *Server) BroadcastEnemies() {
+	data := EnemySnapshotData{make([]EnemySnapshot, 0, len(s.Enemies))}
+	for _, enemy := range s.Enemies {
+		data.Enemies = append(data.Enemies, enemy.Snapshot())
+	}
+
+	packet := Packet{}
+	packet.PacketType = PacketTypeUpdateEnemies
+	s.Broadcast(packet, data)
+}
+
+// lets everyone know which enemies died, so they don't have to wait for the next snapshot to find out
+func (s *Server) BroadcastEnemyDeaths(dead []Enemy) {
+	if len(dead) == 0 {
+		return
+	}
+
+	event := Event{}
+	event.Type = EnemyDiedEvent
+	for _, enemy := range dead {
+		event.EnemyIDs = append(event.EnemyIDs, enemy.ID)
+	}
+
+	packet := Packet{}
+	packet.PacketType = PacketTypeServerEvent
+	s.Broadcast(packet, event)
+}
+
+// TakeEnemyUpdates returns the enemy snapshots that arrived since the last call, oldest first
+func (c *Client) TakeEnemyUpdates() []enemyUpdate {
+	c.enemy_updates_mutex.Lock()
+	defer c.enemy_updates_mutex.Unlock()
+
+	updates := c.enemy_updates
+	c.enemy_updates = nil
+	return updates
+}
+
+func (c *Client) queueEnemyUpdate(update enemyUpdate) {
+	c.enemy_updates_mutex.Lock()
+	c.enemy_updates = append(c.enemy_updates, update)
+	if len(c.enemy_updates) > MAX_QUEUED_ENEMY_UPDATES {
+		c.enemy_updates = c.enemy_updates[len(c.enemy_updates)-MAX_QUEUED_ENEMY_UPDATES:]
+	}
+	c.enemy_updates_mutex.Unlock()
+}
+
+// ApplyEnemyUpdate makes our enemies match the server's. Snapshots that arrive after a newer
+// one only add to the interpolation, they don't add or remove anything
+func (g *Game) ApplyEnemyUpdate(update enemyUpdate) {
+	stale := update.time <= g.lastEnemyUpdate
+	if !stale {
+		g.lastEnemyUpdate = update.time
+	}
+
+	index := make(map[uint]int, len(g.Enemies))
+	for i, enemy := range g.Enemies {
+		index[enemy.ID] = i
+	}
+
+	seen := make(map[uint]bool, len(update.data.Enemies))
+	for _, snapshot := range update.data.Enemies {
+		seen[snapshot.ID] = true
+
+		i, ok := index[snapshot.ID]
+		if !ok {
+			if stale || snapshot.Life <= 0 || g.deadEnemies[snapshot.ID] {
+				continue
+			}
+			g.Enemies = append(g.Enemies, Enemy{
+				ID:       snapshot.ID,
+				Type:     snapshot.Type,
+				Position: snapshot.Position,
+				Lifetime: snapshot.Lifetime,
+			})
+			i = len(g.Enemies) - 1
+			index[snapshot.ID] = i
+		}
+
+		enemy := &g.Enemies[i]
+		enemy.Snapshots.Push(Snapshot{update.time, snapshot.Position, 0})
+		if !stale {
+			enemy.Life = snapshot.Life
+			enemy.Target = snapshot.Target
+		}
+	}
+
+	if stale {
+		return
+	}
+
+	enemies := []Enemy{}
+	for _, enemy := range g.Enemies {
+		if seen[enemy.ID] {
+			enemies = append(enemies, enemy)
+		}
+	}
+	g.Enemies = enemies
+}
+
+// RemoveDeadEnemies takes the enemies the server says have died off the screen with a splat
+func (g *Game) RemoveDeadEnemies(dead []uint) {
+	// ids are never reused, so a snapshot from before the death can't bring it back
+	if g.deadEnemies == nil {
+		g.deadEnemies = make(map[uint]bool)
+	}
+	for _, id := range dead {
+		g.deadEnemies[id] = true
+	}
+
+	enemies := []Enemy{}
+	for _, enemy := range g.Enemies {
+		if !g.deadEnemies[enemy.ID] {
+			enemies = append(enemies, enemy)
+			continue
+		}
+
+		pos := enemy.Position
+		pos.X += TILE_SIZE / 2
+		pos.Y += TILE_SIZE / 2
+		for i := 0; i < 5; i++ {
+			g.Sparks = append(g.Sparks, Spark{5, pos, float64(i) * 1.25, 1.2, 2, color.RGBA{178, 28, 28, 255}})
+		}
+	}
+
+	g.Enemies = enemies
+}
+
+// AddEnemies adds the enemies we don't know about yet, they might have arrived with a snapshot already
+func (g *Game) AddEnemies(spawned []Enemy) {
+	known := make(map[uint]bool, len(g.Enemies))
+	for _, enemy := range g.Enemies {
+		known[enemy.ID] = true
+	}
+
+	for _, enemy := range spawned {
+		if !known[enemy.ID] && !g.deadEnemies[enemy.ID] {
+			g.Enemies = append(g.Enemies, enemy)
+		}
+	}
+}
+
+// ResetEnemies forgets every enemy, the next server might hand out the same ids again
+func (g *Game) ResetEnemies() {
+	g.Enemies = []Enemy{}
+	g.deadEnemies = make(map[uint]bool)
+	g.lastEnemyUpdate = 0
+}
+
+// UpdateEnemies moves our enemies to where the server had them a moment ago, see Client.RenderTime
+func (g *Game) UpdateEnemies() {
+	for _, update := range g.Client.TakeEnemyUpdates() {
+		g.ApplyEnemyUpdate(update)
+	}
+
+	renderTime := g.Client.RenderTime()
+	for i := range g.Enemies {
+		enemy := &g.Enemies[i]
+		position := enemy.Position
+		if enemy.Snapshots.Len() > 0 {
+			position = enemy.Snapshots.Sample(renderTime, g.Client.extrapolation_limit).Position
+		}
+		enemy.Animate(position)
+	}
+}
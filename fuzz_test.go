@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// rawPayload is sent as is, so a payload we received can be put back into a packet
+type rawPayload []byte
+
+func (p rawPayload) EncodeBinary(w *BinaryWriter) {
+	w.buf = append(w.buf, p...)
+}
+
+func FuzzDeserializePacket(f *testing.F) {
+	for i, c := range testPayloads() {
+		raw, err := SerializePacket(Packet{PacketType: PacketType(1 + i%int(PacketTypeCount-1)), Sequence: uint32(i)}, c.value)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(raw)
+	}
+	raw, _ := SerializePacket(Packet{PacketType: PacketTypeAck, SessionToken: 1 << 62}, AckData{3})
+	// what builds before the version field sent
+	f.Add(raw[:LEGACY_HEADER_SIZE])
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		packet, payload, err := DeserializePacket(data)
+		if err != nil {
+			return
+		}
+
+		raw, err := SerializePacket(packet, rawPayload(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, again_payload, err := DeserializePacket(raw)
+		if err != nil {
+			t.Fatalf("accepted %x, but not after encoding it again as %x: %v", data, raw, err)
+		}
+		if again.PacketType != packet.PacketType || again.Sequence != packet.Sequence || again.SessionToken != packet.SessionToken {
+			t.Errorf("header %+v came back as %+v", packet, again)
+		}
+		if !bytes.Equal(again_payload, payload) {
+			t.Errorf("payload %x came back as %x", payload, again_payload)
+		}
+	})
+}
+
+// fuzzDecoder feeds the payload called name anything, whatever it accepts has to encode into
+// something it accepts again, and that has to encode the same way every time
+func fuzzDecoder(f *testing.F, name string) {
+	var c *codecCase
+	payloads := testPayloads()
+	for i := range payloads {
+		if payloads[i].name == name {
+			c = &payloads[i]
+		}
+	}
+	if c == nil {
+		f.Fatalf("no test payload called %s", name)
+	}
+
+	w := BinaryWriter{}
+	c.value.EncodeBinary(&w)
+	f.Add(w.Bytes())
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decoded := c.empty()
+		if NewDecoder(data).Decode(decoded) != nil {
+			return
+		}
+
+		w := BinaryWriter{}
+		decoded.(BinaryEncoder).EncodeBinary(&w)
+		encoded := w.Bytes()
+
+		again := c.empty()
+		err := NewDecoder(encoded).Decode(again)
+		if err != nil {
+			t.Fatalf("accepted %x, but not after encoding it again as %x: %v", data, encoded, err)
+		}
+
+		w = BinaryWriter{}
+		again.(BinaryEncoder).EncodeBinary(&w)
+		if !bytes.Equal(w.Bytes(), encoded) {
+			t.Errorf("encoded as %x, then as %x", encoded, w.Bytes())
+		}
+	})
+}
+
+func FuzzReconcilliationData(f *testing.F) { fuzzDecoder(f, "ReconcilliationData") }
+func FuzzErrorData(f *testing.F)           { fuzzDecoder(f, "ErrorData") }
+func FuzzRelayData(f *testing.F)           { fuzzDecoder(f, "RelayData") }
+func FuzzAckData(f *testing.F)             { fuzzDecoder(f, "AckData") }
+func FuzzFragmentData(f *testing.F)        { fuzzDecoder(f, "FragmentData") }
+func FuzzPingData(f *testing.F)            { fuzzDecoder(f, "PingData") }
+func FuzzPongData(f *testing.F)            { fuzzDecoder(f, "PongData") }
+func FuzzHostMetadata(f *testing.F)        { fuzzDecoder(f, "HostMetadata") }
+func FuzzLobbyInfo(f *testing.F)           { fuzzDecoder(f, "LobbyInfo") }
+func FuzzLobbyListData(f *testing.F)       { fuzzDecoder(f, "LobbyListData") }
+func FuzzLanAnnounceData(f *testing.F)     { fuzzDecoder(f, "LanAnnounceData") }
+func FuzzServerStateData(f *testing.F)     { fuzzDecoder(f, "ServerStateData") }
+func FuzzCoordinateData(f *testing.F)      { fuzzDecoder(f, "CoordinateData") }
+func FuzzNegotiationRequest(f *testing.F)  { fuzzDecoder(f, "NegotiationRequest") }
+func FuzzNegotiationResponse(f *testing.F) { fuzzDecoder(f, "NegotiationResponse") }
+func FuzzConnectedPlayer(f *testing.F)     { fuzzDecoder(f, "ConnectedPlayer") }
+func FuzzPlayerSnapshotData(f *testing.F)  { fuzzDecoder(f, "PlayerSnapshotData") }
+func FuzzHitInfo(f *testing.F)             { fuzzDecoder(f, "HitInfo") }
+func FuzzPlayerUpdateData(f *testing.F)    { fuzzDecoder(f, "PlayerUpdateData") }
+func FuzzPlayerInput(f *testing.F)         { fuzzDecoder(f, "PlayerInput") }
+func FuzzBullet(f *testing.F)              { fuzzDecoder(f, "Bullet") }
+func FuzzModifiers(f *testing.F)           { fuzzDecoder(f, "Modifiers") }
+func FuzzServerState(f *testing.F)         { fuzzDecoder(f, "ServerState") }
+func FuzzEnemy(f *testing.F)               { fuzzDecoder(f, "Enemy") }
+func FuzzEnemySnapshotData(f *testing.F)   { fuzzDecoder(f, "EnemySnapshotData") }
+func FuzzEvent(f *testing.F)               { fuzzDecoder(f, "Event") }
@@ -2,13 +2,17 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"image/color"
 	"log"
 	"math"
 	"math/rand"
+	"net"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/hajimehoshi/ebiten/v2"
 	"github.com/hajimehoshi/ebiten/v2/inpututil"
@@ -28,6 +32,7 @@ const (
 	SERVER_PLAYER_SYNC_DELAY_MS = 50
 	TOGGLECOOLDOWN              = 30
 	TIMEOUT_INTERVAL_MS         = 2500
+	DISCONNECT_REDUNDANCY       = 3
 	MAX_SPAWN_COUNT             = 12
 	MINIMUM_SPAWN_COOLDOWN      = 30
 	INITAL_SPAWN_COOLDOWN       = 60
@@ -38,9 +43,9 @@ const (
 
 var WHITE color.RGBA = color.RGBA{255, 255, 255, 255}
 var BLACK color.RGBA = color.RGBA{0, 0, 0, 255}
-var HOSTSMITHSPRITE = GetSpriteByID(86)
-var JOINWIZARDSPRITE = GetSpriteByID(84)
-var TOMBSPRITE = GetSpriteByID(64)
+var HOSTSMITHSPRITE *ebiten.Image
+var JOINWIZARDSPRITE *ebiten.Image
+var TOMBSPRITE *ebiten.Image
 
 type TransitionState int
 
@@ -57,53 +62,86 @@ type Transition struct {
 	Speed    float64
 }
 
+// what we need to get back into a game we dropped out of
+type Session struct {
+	JoinKey      string
+	SessionToken uint64
+}
+
 type Game struct {
-	Player      Player
-	Client      *Client
-	Server      *Server
-	FrameCount  uint64
-	Level       *Level
-	Camera      Camera
-	Sparks      []Spark
-	Enemies     []Enemy
-	Debris      []Bullet
-	Boons       []Boon
-	Tombs       []ConnectedPlayer
-	LevelCount  int
-	Modifiers   Modifiers
-	JoinKey     string
-	BigTextBuff string
-	Healthbar   *Healthbar
+	Player       Player
+	Client       *Client
+	Server       *Server
+	FrameCount   uint64
+	Level        *Level
+	Camera       Camera
+	Sparks       []Spark
+	Enemies      []Enemy
+	Debris       []Bullet
+	Boons        []Boon
+	Tombs        map[uint]ConnectedPlayer
+	LevelCount   int
+	Modifiers    Modifiers
+	JoinKey      string
+	Config       Config
+	LanBrowser   *LanBrowser
+	LobbyBrowser *LobbyBrowser
+	BigTextBuff  string
+	Healthbar    *Healthbar
+	LastSession  Session
 
 	Transitions     []Transition
 	TransitionState TransitionState
 	TransitionWidth float64
 
-	toggleCooldown        int
-	isTypingJoinCode      bool
-	ShouldCleanEnemies    bool
-	isInWaitingRoom       bool
+	toggleCooldown int
+	selectedGame   int
+	// the join code we show while hosting
+	hostedCode         string
+	isTypingJoinCode   bool
+	ShouldCleanEnemies bool
+	// server time of the newest enemy snapshot we have used
+	lastEnemyUpdate int64
+	// enemies the server has told us are dead, see RemoveDeadEnemies
+	deadEnemies map[uint]bool
+	// closing it stops the server we host
+	stopServer      chan struct{}
+	isInWaitingRoom bool
+	// while set we are connecting to connectingKey, see updateConnection
+	connectDeadline time.Time
+	connectingKey   string
 }
 
 func (g *Game) Update() error {
 	g.FrameCount++
 
 	if g.Server != nil {
-		g.Server.Update()
+		// the mediation server hands out another code if ours was taken
+		if code := g.Server.JoinCode(); code != "" && code != g.hostedCode {
+			if g.BigTextBuff == g.hostedCode {
+				g.BigTextBuff = code
+			}
+			g.hostedCode = code
+		}
+	}
+
+	if g.Client != nil && !g.connectDeadline.IsZero() {
+		g.updateConnection()
+	}
+
+	if g.Client != nil && g.Server == nil && g.Client.LostConnection() {
+		g.LeaveSession()
 	}
 
 	if g.Client != nil {
 		g.HandleEvent()
 	}
 
-	if g.Client != nil && g.Client.is_connected && (g.FrameCount%3 == 0) {
-		g.Client.SendPosition(
-			g.Player.Position,
+	if g.Client != nil && g.Client.IsConnected() && (g.FrameCount%3 == 0) {
+		g.Client.SendInputs(
 			g.Player.Rotation,
 			g.Player.Weapon,
-			g.Player.RollDuration > 0,
-			g.Player.Life,
-		) // TODO
+		)
 	}
 
 	if g.ShouldCleanEnemies {
@@ -123,16 +161,43 @@ func (g *Game) Update() error {
 	g.Camera.Update(camera_target_pos)
 	if g.isTypingJoinCode {
 		g.BigTextBuff = "join key: " + g.JoinKey
+
+		// using the typed characters rather than keys so addresses can be typed in as well
+		for _, char := range ebiten.AppendInputChars(nil) {
+			g.JoinKey += strings.ToUpper(string(char))
+		}
+
+		g.LobbyBrowser.Refresh()
+		entries := g.BrowserEntries()
+		if len(entries) > 0 {
+			if inpututil.IsKeyJustPressed(ebiten.KeyDown) {
+				g.selectedGame = (g.selectedGame + 1) % len(entries)
+			}
+			if inpututil.IsKeyJustPressed(ebiten.KeyUp) {
+				g.selectedGame = (g.selectedGame + len(entries) - 1) % len(entries)
+			}
+			g.selectedGame = min(g.selectedGame, len(entries)-1)
+		}
+
 		keys := make([]ebiten.Key, 0)
 		keys = inpututil.AppendJustPressedKeys(keys)
 		for _, k := range keys {
-			if len(k.String()) == 1 {
-				g.JoinKey += k.String()
-			} else if k == ebiten.KeyBackspace && len(g.JoinKey) > 0 {
+			if k == ebiten.KeyBackspace && len(g.JoinKey) > 0 {
 				g.JoinKey = g.JoinKey[:len(g.JoinKey)-1]
 			} else if k == ebiten.KeyEnter {
 				g.isTypingJoinCode = false
-				g.Join()
+				// nothing typed means we want the game picked in the list
+				if g.JoinKey == "" && len(entries) > 0 {
+					entry := entries[g.selectedGame]
+					if entry.Addr != nil {
+						g.JoinDirect(*entry.Addr, entry.Addr.String())
+					} else {
+						g.JoinKey = entry.Code
+						g.Join()
+					}
+				} else {
+					g.Join()
+				}
 			} else if k == ebiten.KeyEscape {
 				g.BigTextBuff = ""
 				g.isTypingJoinCode = false
@@ -140,6 +205,7 @@ func (g *Game) Update() error {
 		}
 	} else {
 		if ebiten.IsKeyPressed(ebiten.KeyQ) {
+			g.Quit()
 			return ebiten.Termination
 		}
 
@@ -160,6 +226,11 @@ func (g *Game) Update() error {
 			g.toggleCooldown = TOGGLECOOLDOWN
 		}
 
+		if g.Client != nil {
+			if authoritative, ok := g.Client.TakeAuthoritativeState(); ok {
+				g.Player.Reconcile(authoritative, g)
+			}
+		}
 		g.Player.Update(g)
 
 		if ebiten.IsKeyPressed(ebiten.KeyE) && g.toggleCooldown == 0 && g.Client != nil {
@@ -203,7 +274,9 @@ func (g *Game) Update() error {
 				g.Player.Weapon,
 				speed,
 				0,
-				GetWeaponFriendlyFire(g.Player.Weapon)},
+				GetWeaponFriendlyFire(g.Player.Weapon),
+				g.Client.RenderTime(),
+				0},
 			)
 
 			if WeaponHasSpark(g.Player.Weapon) {
@@ -222,13 +295,6 @@ func (g *Game) Update() error {
 
 		g.Player.ShootCooldown = max(0, g.Player.ShootCooldown-.16)
 
-		if ebiten.IsKeyPressed(ebiten.KeySpace) && g.Player.RollCooldown == 0 && g.Client != nil {
-			g.Client.SendRoll()
-			g.Player.RollCooldown = 100
-		}
-
-		g.Player.RollCooldown = max(0, g.Player.RollCooldown-1)
-
 		g.Client.bullets_mutex.Lock()
 		for i, bullet := range g.Client.bullets {
 			x := math.Cos(bullet.Rotation)
@@ -252,13 +318,13 @@ func (g *Game) Update() error {
 			hitEnemy := false
 
 			if !bullet.HurtsPlayer {
-				for key, enemy := range g.Enemies {
+				for _, enemy := range g.Enemies {
 					if bullet.Position.X < enemy.Position.X+TILE_SIZE &&
 						bullet.Position.X+4 > enemy.Position.X && // 4 is width
 						bullet.Position.Y < enemy.Position.Y+TILE_SIZE &&
 						bullet.Position.Y+4 > enemy.Position.Y { // 4 is height
+						// only for the splat, the server decides what the bullet did to it
 						hitEnemy = true
-						g.Enemies[key].Life = max(0, enemy.Life-int(damage))
 						break
 					}
 				}
@@ -298,23 +364,22 @@ func (g *Game) Update() error {
 		g.Client.bullets = bullets
 		g.Client.bullets_mutex.Unlock()
 
-		states := make(map[string]PlayerState)
+		states := make(map[uint]PlayerState)
 		g.Client.player_states_mutex.Lock()
 		for key, state := range g.Client.player_states {
-			if g.Client.IsSelf(state.Connection.Addr) {
+			if g.Client.IsSelf(state.Connection.ID) {
 				states[key] = state
 				continue
 			}
 
-			currentRelativePosition := state.GetInterpolatedPos()
-			if state.CurrentPos.X != currentRelativePosition.X || state.CurrentPos.Y != currentRelativePosition.Y {
+			rendered := g.Client.RenderState(&state)
+			if state.LatestPos() != rendered.Position {
 				state.MoveDuration += 1
 			} else {
 				state.MoveDuration = state.MoveDuration % 30
 				state.MoveDuration = max(0, state.MoveDuration-1)
 			}
 
-			state.FrameCount++
 			states[key] = state
 		}
 
@@ -333,26 +398,9 @@ func (g *Game) Update() error {
 	}
 	g.Sparks = sparks
 
-	enemies := []Enemy{}
-	for key := range g.Enemies {
-		target := g.Client.GetStateByAddr(g.Enemies[key].Target)
-
-		if target != nil {
-			if target.Connection.Life > 0 {
-				g.Enemies[key].FindPath(target.CurrentPos, g.Level.ObstacleMatrix)
-			} else {
-				g.Enemies[key].FindPath(target.Connection.DeadPosition, g.Level.ObstacleMatrix)
-			}
-		} else {
-			log.Println("enemy could not find target player")
-		}
-
-		g.Enemies[key].Update()
-		if g.Enemies[key].Life > 0 {
-			enemies = append(enemies, g.Enemies[key])
-		}
+	if g.Client != nil {
+		g.UpdateEnemies()
 	}
-	g.Enemies = enemies
 
 	if g.Level.HostSmith != nil {
 		pos := Position{g.Level.HostSmith.X, g.Level.HostSmith.Y}
@@ -371,6 +419,9 @@ func (g *Game) Update() error {
 		if distance < BOON_INTERACT_RANGE && ebiten.IsKeyPressed(ebiten.KeyE) && g.Server == nil && g.toggleCooldown == 0 {
 			g.toggleCooldown = TOGGLECOOLDOWN
 			g.isTypingJoinCode = true
+			if g.JoinKey == "" {
+				g.JoinKey = g.LastSession.JoinKey
+			}
 		}
 	}
 	g.UpdateTransition()
@@ -414,11 +465,18 @@ func (g *Game) Draw(screen *ebiten.Image) {
 			textOp.GeoM.Translate(SCREEN_WIDTH/2, SCREEN_HEIGHT-fontSize*3)
 			textOp.GeoM.Translate(-float64(len(msg)/2)*fontSize, fontSize)
 			text.Draw(screen, msg, &text.GoTextFace{Source: fontFaceSource, Size: fontSize}, &textOp)
+
+			seedOp := text.DrawOptions{}
+			seedMsg := fmt.Sprintf("seed %d", g.Client.Seed())
+			seedFontSize := 6.
+			seedOp.GeoM.Translate(SCREEN_WIDTH/2, SCREEN_HEIGHT-fontSize*2)
+			seedOp.GeoM.Translate(-float64(len(seedMsg)/2)*seedFontSize, seedFontSize)
+			text.Draw(screen, seedMsg, &text.GoTextFace{Source: fontFaceSource, Size: seedFontSize}, &seedOp)
 		}
 
 		g.Client.player_states_mutex.RLock()
 		for _, state := range g.Client.player_states {
-			if g.Client.IsSelf(state.Connection.Addr) {
+			if g.Client.IsSelf(state.Connection.ID) {
 				continue
 			}
 
@@ -429,7 +487,9 @@ func (g *Game) Draw(screen *ebiten.Image) {
 				op.GeoM.Translate(8, 8)
 			}
 
-			RenderPos := state.GetInterpolatedPos()
+			rendered := g.Client.RenderState(&state)
+			RenderPos := rendered.Position
+			rotation := rendered.Rotation
 			op.GeoM.Translate(RenderPos.X, RenderPos.Y)
 			op.GeoM.Translate(-g.Camera.Offset.X, -g.Camera.Offset.Y)
 
@@ -440,15 +500,15 @@ func (g *Game) Draw(screen *ebiten.Image) {
 				op = ebiten.DrawImageOptions{}
 				op.GeoM.Translate(-distance, -distance)
 
-				if math.Pi*.5 < state.Connection.Rotation || state.Connection.Rotation < -math.Pi*.5 {
+				if math.Pi*.5 < rotation || rotation < -math.Pi*.5 {
 					op.GeoM.Scale(1, -1)
 				}
-				op.GeoM.Rotate(state.Connection.Rotation)
+				op.GeoM.Rotate(rotation)
 
 				op.GeoM.Translate(distance, distance)
 
-				x := math.Cos(state.Connection.Rotation)
-				y := math.Sin(state.Connection.Rotation)
+				x := math.Cos(rotation)
+				y := math.Sin(rotation)
 
 				op.GeoM.Translate(x*distance, y*distance)
 
@@ -462,6 +522,22 @@ func (g *Game) Draw(screen *ebiten.Image) {
 				screen.DrawImage(GhostSprite, &op)
 			}
 
+			if g.isInWaitingRoom {
+				textOp := text.DrawOptions{}
+				fontSize := 6.
+				msg := fmt.Sprintf("%dms", state.RTT.Milliseconds())
+				textOp.GeoM.Translate(RenderPos.X-g.Camera.Offset.X, RenderPos.Y-g.Camera.Offset.Y-fontSize*2)
+				drawTextWithStroke(
+					screen,
+					msg,
+					&text.GoTextFace{Source: fontFaceSource, Size: fontSize},
+					color.RGBA{255, 255, 255, 255},
+					color.RGBA{0, 0, 0, 255},
+					1,
+					&textOp,
+				)
+			}
+
 		}
 		g.Client.player_states_mutex.RUnlock()
 
@@ -566,7 +642,7 @@ func (g *Game) Draw(screen *ebiten.Image) {
 			textOp := text.DrawOptions{}
 			textOp.GeoM = op.GeoM
 			fontSize := 8.
-			msg := "press 'e' to type join code"
+			msg := "press 'e' to type join code or ip"
 			if g.isTypingJoinCode {
 				msg = "'enter' to confirm"
 			}
@@ -583,6 +659,10 @@ func (g *Game) Draw(screen *ebiten.Image) {
 		}
 	}
 
+	if g.isTypingJoinCode {
+		g.DrawBrowser(screen)
+	}
+
 	textOp := text.DrawOptions{}
 	textOp.GeoM.Translate(SCREEN_WIDTH/2, 0)
 	fontSize := 16.
@@ -598,6 +678,22 @@ func (g *Game) Draw(screen *ebiten.Image) {
 	)
 
 	g.Healthbar.Draw(screen)
+
+	if g.Client != nil && g.Client.IsConnected() && g.Server == nil {
+		textOp := text.DrawOptions{}
+		fontSize := 8.
+		msg := fmt.Sprintf("%dms", g.Client.RTT().Milliseconds())
+		textOp.GeoM.Translate(SCREEN_WIDTH-float64(len(msg)+1)*fontSize, fontSize)
+		drawTextWithStroke(
+			screen,
+			msg,
+			&text.GoTextFace{Source: fontFaceSource, Size: fontSize},
+			color.RGBA{255, 255, 255, 255},
+			color.RGBA{0, 0, 0, 255},
+			1,
+			&textOp,
+		)
+	}
 }
 
 func (g *Game) Layout(outsideWidth, outsideHeight int) (screenWidth, screenHeight int) {
@@ -667,7 +763,7 @@ func (g *Game) HandleEvent() {
 		g.ShouldCleanEnemies = true
 		g.ChangeLevel(event_data.Level)
 		g.TransitionState = TransitionStateEnding
-		g.Tombs = []ConnectedPlayer{}
+		g.Tombs = map[uint]ConnectedPlayer{}
 		g.Boons = []Boon{}
 
 		g.LevelCount++
@@ -681,12 +777,18 @@ func (g *Game) HandleEvent() {
 		g.Player.Life = int(l * PLAYER_LIFE)
 		g.Healthbar.MaxLife = g.Player.Life
 	case SpawnEnemiesEvent:
-		g.Enemies = append(g.Enemies, event_data.Enemies...)
+		g.AddEnemies(event_data.Enemies)
+	case EnemyDiedEvent:
+		g.RemoveDeadEnemies(event_data.EnemyIDs)
 	case PlayerDiedEvent:
-		g.Tombs = append(g.Tombs, event_data.Player)
+		g.Tombs[event_data.Player.ID] = event_data.Player
 	case SpawnBoonEvent:
 		g.ShouldCleanEnemies = true
 		for i, mod := range event_data.Modifiers {
+			// boons draw the first modifier of each kind, and each needs a spot to stand on
+			if i >= len(g.Level.BoonSpawns) || len(mod.Player) == 0 || len(mod.Monster) == 0 {
+				continue
+			}
 			g.Boons = append(g.Boons, Boon{mod, g.Level.BoonSpawns[i], 0})
 		}
 	case PrepareNewLevelEvent:
@@ -694,70 +796,284 @@ func (g *Game) HandleEvent() {
 		// maybe make them do the cool
 	case GameOverEvent:
 		g.BigTextBuff = "GAME OVER"
+	case RestorePlayerEvent:
+		g.ChangeLevel(event_data.Level)
+		g.isInWaitingRoom = event_data.Level == LobbyLevel
+
+		g.Player.Position = event_data.Player.Position
+		if event_data.Player.Life <= 0 {
+			g.Player.Position = event_data.Player.DeadPosition
+		}
+		g.Player.Life = event_data.Player.Life
+		g.Healthbar.MaxLife = int(g.Modifiers.GetModifiedPlayerValue(ModifierTypeLife) * PLAYER_LIFE)
 	}
 	g.Client.EventQueue = g.Client.EventQueue[1:]
 }
 
 func (g *Game) Host() {
 	LoadLevel(g.Level, LobbyLevel)
-	server := Server{level: g.Level}
+	server := Server{}
 	g.Server = &server
 
 	client := Client{}
 	client.Modifiers = &g.Modifiers
 	client.PlayerLifePtr = &g.Player.Life
+	client.SetInterpolation(g.Config)
 
 	g.Player.Position = Position{g.Level.Spawn.X, g.Level.Spawn.Y}
 
 	g.Client = &client
 
-	const letters = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	code := NewJoinCode()
 
-	result := make([]byte, 4)
-	for i := range result {
-		result[i] = letters[rand.Intn(len(letters))]
-	}
-
-	key := fmt.Sprintf("gmtk2024:%s", result)
-	g.BigTextBuff = string(result)
-	go server.Host("84.215.22.166", key)
-	go client.RunLocalClient()
+	key := JOIN_KEY_PREFIX + code
+	g.BigTextBuff = code
+	g.hostedCode = code
+	// runs until we quit, at its own pace rather than ours
+	g.stopServer = make(chan struct{})
+	go server.Host(g.Config, key, g.stopServer)
+	go client.RunLocalClient(g.Config)
 
 	g.isInWaitingRoom = true
 
 }
 
+// Join joins whatever was typed at the JoinWizard, which is either a join code or an ip with an optional port
 func (g *Game) Join() {
+	joinKey := g.JoinKey
+	g.JoinKey = ""
+
+	// join codes are only letters, so anything with a dot or a colon has to be an address
+	if strings.ContainsAny(joinKey, ".:") {
+		addr, err := ResolveHostAddr(joinKey, g.Config.ServerPort)
+		if err != nil {
+			fmt.Println("could not resolve", joinKey, err)
+			g.BigTextBuff = "invalid address"
+			return
+		}
+		g.JoinDirect(*addr, joinKey)
+		return
+	}
+
+	client := g.newClient(joinKey)
+	go client.RunClient(g.Config, JOIN_KEY_PREFIX+joinKey) // this should be some buffer
+
+	g.waitForConnection(joinKey)
+}
+
+// JoinDirect joins a host without going through the mediation server, sessionKey is what we
+// remember the game by in case we have to rejoin it
+func (g *Game) JoinDirect(addr net.UDPAddr, sessionKey string) {
+	client := g.newClient(sessionKey)
+	go client.RunDirectClient(g.Config, addr)
+
+	g.waitForConnection(sessionKey)
+}
+
+func (g *Game) newClient(sessionKey string) *Client {
 	client := Client{}
 	client.Modifiers = &g.Modifiers
 	client.PlayerLifePtr = &g.Player.Life
+	client.SetInterpolation(g.Config)
+
+	// the host gives us our old player back if it still remembers this token
+	if sessionKey == g.LastSession.JoinKey {
+		client.SessionToken = g.LastSession.SessionToken
+	}
 
 	g.Client = &client
-	go client.RunClient("84.215.22.166", fmt.Sprintf("gmtk2024:%s", g.JoinKey)) // this should be some buffer
+	return &client
+}
 
-	g.JoinKey = ""
+// waitForConnection gives the client CONNECT_TIMEOUT_MS to connect, it is checked on every frame
+// by updateConnection so the window keeps responding in the meantime
+func (g *Game) waitForConnection(joinKey string) {
 	g.BigTextBuff = "connecting..."
-	if !g.Client.CheckConnected() {
-		g.BigTextBuff = "failed to connect"
-		g.Client = nil
-		return
-	} else {
+	g.connectingKey = joinKey
+	g.connectDeadline = time.Now().Add(time.Millisecond * CONNECT_TIMEOUT_MS)
+}
+
+func (g *Game) updateConnection() {
+	if g.Client.IsConnected() {
+		g.connectDeadline = time.Time{}
+		g.LastSession = Session{g.connectingKey, g.Client.SessionToken}
 		g.BigTextBuff = ""
 		LoadLevel(g.Level, LobbyLevel)
 		g.isInWaitingRoom = true
 
 		g.Player.Position = Position{g.Level.Spawn.X, g.Level.Spawn.Y}
+		return
+	}
+
+	if g.Client.ConnectError() == nil && time.Now().Before(g.connectDeadline) {
+		return
+	}
+
+	g.connectDeadline = time.Time{}
+	g.BigTextBuff = "failed to connect"
+	if errors.Is(g.Client.ConnectError(), ErrVersionMismatch) {
+		g.BigTextBuff = "version mismatch"
+	} else if errors.Is(g.Client.ConnectError(), ErrGameInProgress) {
+		g.BigTextBuff = "game already started"
+	} else if errors.Is(g.Client.ConnectError(), ErrRelayDisabled) {
+		g.BigTextBuff = "host unreachable"
+	}
+	g.Client.Close()
+	g.Client = nil
+}
+
+// lets everyone else know we are leaving instead of making them wait for us to time out
+func (g *Game) Quit() {
+	if g.Server != nil {
+		g.Server.Shutdown()
+		close(g.stopServer)
+	} else if g.Client != nil {
+		g.Client.Disconnect()
+	}
+}
+
+// LeaveSession drops a connection that went quiet and puts us back in the pregame level.
+// LastSession is kept unless the host left, so the join wizard can take us back in
+func (g *Game) LeaveSession() {
+	g.BigTextBuff = "connection lost"
+	if g.Client.host_left {
+		g.BigTextBuff = "host left"
+		g.LastSession = Session{}
+	}
+	g.Client.Close()
+	g.Client = nil
+
+	level := LoadPregameLevel()
+	g.Level = &level
+
+	g.ResetEnemies()
+	g.Boons = []Boon{}
+	g.Tombs = map[uint]ConnectedPlayer{}
+	g.Debris = []Bullet{}
+	g.Modifiers = Modifiers{}
+	g.LevelCount = 0
+	g.isInWaitingRoom = false
+	g.TransitionState = TransitionStateNone
+	g.Transitions = []Transition{}
+
+	g.Player.Life = PLAYER_LIFE
+	g.Healthbar.MaxLife = PLAYER_LIFE
+	if g.Level.Spawn != nil {
+		g.Player.Position = Position{g.Level.Spawn.X, g.Level.Spawn.Y}
+	}
+}
+
+// sprites are only loaded when we have a window, a dedicated server never touches them
+func LoadSprites() {
+	HOSTSMITHSPRITE = GetSpriteByID(86)
+	JOINWIZARDSPRITE = GetSpriteByID(84)
+	TOMBSPRITE = GetSpriteByID(64)
+	BOONSPRITES = []*ebiten.Image{GetSpriteByID(89), GetSpriteByID(90), GetSpriteByID(91)}
+	GhostSprite = GetSpriteByID(121)
+	polygonImage = ebiten.NewImage(1, 1)
+
+	InitializeWeapons()
+	InitializeCharacters()
+}
+
+// a game that can be picked at the join prompt, found either on the LAN or at the mediation server
+type BrowserEntry struct {
+	Label string
+	// set for LAN games, which are joined directly
+	Addr *net.UDPAddr
+	// join code of a public lobby
+	Code string
+}
+
+func (g *Game) BrowserEntries() []BrowserEntry {
+	entries := []BrowserEntry{}
+	for _, lanGame := range g.LanBrowser.Games() {
+		label := fmt.Sprintf("LAN %s %s %d players", lanGame.Code, lanGame.Addr.String(), lanGame.PlayerCount)
+		if lanGame.Started {
+			label += " (started)"
+		}
+		addr := lanGame.Addr
+		entries = append(entries, BrowserEntry{label, &addr, lanGame.Code})
+	}
+
+	for _, lobby := range g.LobbyBrowser.Lobbies() {
+		label := fmt.Sprintf("%s %s %d/%d ready", lobby.Code, lobby.HostName, lobby.ReadyCount, lobby.PlayerCount)
+		if lobby.Version != PROTOCOL_VERSION {
+			label += " (other version)"
+		}
+		entries = append(entries, BrowserEntry{label, nil, lobby.Code})
+	}
+
+	return entries
+}
+
+// lists the games we know of under the join prompt
+func (g *Game) DrawBrowser(screen *ebiten.Image) {
+	entries := g.BrowserEntries()
+	if len(entries) == 0 {
+		return
+	}
+
+	fontSize := 8.
+	lines := []string{"games, up/down and 'enter' to join:"}
+	for i, entry := range entries {
+		cursor := "  "
+		if i == g.selectedGame {
+			cursor = "> "
+		}
+		lines = append(lines, cursor+entry.Label)
+	}
+
+	for i, line := range lines {
+		textOp := text.DrawOptions{}
+		textOp.GeoM.Translate(fontSize, 80+float64(i)*(fontSize+4))
+		drawTextWithStroke(
+			screen,
+			line,
+			&text.GoTextFace{Source: fontFaceSource, Size: fontSize},
+			color.RGBA{255, 255, 255, 255},
+			color.RGBA{0, 0, 0, 255},
+			1,
+			&textOp,
+		)
 	}
 }
 
 func main() {
 	is_server := flag.String("server", "n", "run server")
 	is_host := flag.String("host", "n", "host")
+	is_dedicated := flag.String("dedicated", "n", "run a game server without a window")
+	join_code := flag.String("key", "", "join key of the dedicated server, random if empty")
+	config_path := flag.String("config", DEFAULT_CONFIG_PATH, "config file, see Config")
+
+	config := DefaultConfig()
+	config_flags := config.RegisterFlags(flag.CommandLine)
 
 	flag.Parse()
 
+	err := config.LoadConfigFile(*config_path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = config.LoadEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.ApplyFlags(flag.CommandLine, config_flags)
+
+	err = config.Validate()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	if *is_server == "y" {
-		RunMediationServer()
+		RunMediationServer(config)
+		return
+	}
+
+	if *is_dedicated == "y" {
+		// join keys are typed in with the keyboard, which only gives us upper case letters
+		RunDedicatedServer(config, strings.ToUpper(*join_code))
 		return
 	}
 
@@ -778,8 +1094,7 @@ func main() {
 
 	fontFaceSource = s
 
-	InitializeWeapons()
-	InitializeCharacters()
+	LoadSprites()
 
 	player_sprite := GetSpriteByID(98) // PLAYER SPRITE
 
@@ -792,7 +1107,9 @@ func main() {
 			Weapon:    WeaponBow,
 			Life:      PLAYER_LIFE,
 		},
-		Level: &level,
+		Level:  &level,
+		Tombs:  map[uint]ConnectedPlayer{},
+		Config: config,
 	}
 
 	game.Healthbar = &Healthbar{
@@ -807,6 +1124,9 @@ func main() {
 		FillColor:     color.RGBA{100, 190, 50, 255},
 	}
 
+	game.LanBrowser = NewLanBrowser(config.LanPort)
+	game.LobbyBrowser = NewLobbyBrowser(config)
+
 	if *is_host == "y" {
 		game.Host()
 	}
@@ -0,0 +1,40 @@
+package main
+
+const (
+	// the furthest back the server looks when resolving a bullet, anyone seeing the world
+	// later than this has to lead their shots
+	MAX_REWIND_MS = 200
+	// how far the view time a shooter sends may be from the one we work out for it
+	VIEW_TIME_TOLERANCE_MS = 50
+)
+
+// RewindFor returns how far back bullets shot by someone who saw the world at viewTime have to look
+func RewindFor(now int64, viewTime int64) int64 {
+	return max(0, min(MAX_REWIND_MS, now-viewTime))
+}
+
+// EstimateViewTime is when the world a shot arriving now was aimed at happened. The shooter saw it
+// interpolationDelay ms late and its shot took half the round trip to get here. What the shooter
+// claims is only trusted within VIEW_TIME_TOLERANCE_MS of that
+func EstimateViewTime(now int64, rtt uint32, interpolationDelay int64, claimed int64) int64 {
+	estimate := now - int64(rtt)/2 - interpolationDelay
+	return max(estimate-VIEW_TIME_TOLERANCE_MS, min(estimate+VIEW_TIME_TOLERANCE_MS, claimed))
+}
+
+// PositionAt returns where the enemy was at a point in server time, as far as its history goes back
+func (e *Enemy) PositionAt(time int64) Position {
+	if e.Snapshots.Len() == 0 {
+		return e.Position
+	}
+	return e.Snapshots.Sample(time, 0).Position
+}
+
+// RecordEnemyPositions remembers where every enemy is now, so bullets can be checked against
+// where their shooter saw them
+//
+// Note that calls of this method should happen from Server.Update, which owns s.Enemies
+func (s *Server) RecordEnemyPositions(now int64) {
+	for i := range s.Enemies {
+		s.Enemies[i].Snapshots.Push(Snapshot{now, s.Enemies[i].Position, 0})
+	}
+}
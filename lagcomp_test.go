@@ -0,0 +1,79 @@
+package main
+
+import "testing"
+
+func TestRewindFor(t *testing.T) {
+	now := int64(1_000_000)
+	cases := []struct {
+		view_time int64
+		want      int64
+	}{
+		{now, 0},
+		{now - 80, 80},
+		{now - MAX_REWIND_MS, MAX_REWIND_MS},
+		// nobody gets to shoot further into the past than MAX_REWIND_MS
+		{now - 5000, MAX_REWIND_MS},
+		// or into the future
+		{now + 100, 0},
+	}
+
+	for _, c := range cases {
+		if got := RewindFor(now, c.view_time); got != c.want {
+			t.Errorf("RewindFor(now, now%+d) = %d, want %d", c.view_time-now, got, c.want)
+		}
+	}
+}
+
+func TestEstimateViewTime(t *testing.T) {
+	now := int64(1_000_000)
+	rtt := uint32(60)
+	delay := int64(DEFAULT_INTERPOLATION_DELAY_MS)
+	estimate := now - 30 - delay
+
+	cases := []struct {
+		name    string
+		claimed int64
+		want    int64
+	}{
+		{"honest", estimate - 10, estimate - 10},
+		{"too far back", estimate - 1000, estimate - VIEW_TIME_TOLERANCE_MS},
+		{"ahead of us", now + 1000, estimate + VIEW_TIME_TOLERANCE_MS},
+		{"not sent", 0, estimate - VIEW_TIME_TOLERANCE_MS},
+	}
+
+	for _, c := range cases {
+		if got := EstimateViewTime(now, rtt, delay, c.claimed); got != c.want {
+			t.Errorf("%s: got %d, want %d", c.name, got, c.want)
+		}
+	}
+}
+
+func TestPositionAt(t *testing.T) {
+	enemy := Enemy{Position: Position{50, 60}}
+	if got := enemy.PositionAt(1000); got != enemy.Position {
+		t.Errorf("without any history got %v, want where it is now %v", got, enemy.Position)
+	}
+
+	enemy.Snapshots.Push(Snapshot{1000, Position{0, 0}, 0})
+	enemy.Snapshots.Push(Snapshot{1200, Position{100, -40}, 0})
+
+	cases := []struct {
+		time int64
+		want Position
+	}{
+		{1000, Position{0, 0}},
+		{1050, Position{25, -10}},
+		{1100, Position{50, -20}},
+		{1200, Position{100, -40}},
+		// the history doesn't go further back, so the oldest is as good as it gets
+		{500, Position{0, 0}},
+		// the server never guesses where an enemy is going
+		{1300, Position{100, -40}},
+	}
+
+	for _, c := range cases {
+		if got := enemy.PositionAt(c.time); got != c.want {
+			t.Errorf("PositionAt(%d) = %v, want %v", c.time, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	LAN_ANNOUNCE_INTERVAL_MS = 1000
+	// games we haven't heard from in this long are dropped from the list
+	LAN_GAME_TIMEOUT_MS = 3500
+)
+
+// broadcast by hosts to everyone on the local network, the address it came from is where the game is
+type LanAnnounceData struct {
+	Code        string
+	PlayerCount uint
+	Started     bool
+}
+
+type LanGame struct {
+	Addr        net.UDPAddr
+	Code        string
+	PlayerCount uint
+	Started     bool
+	LastSeen    time.Time
+}
+
+// Note that calls of this method should happen after Host has set up the socket
+func (s *Server) AnnounceLAN(port int) {
+	broadcast_addr := net.UDPAddr{IP: net.IPv4bcast, Port: port}
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-time.After(time.Millisecond * LAN_ANNOUNCE_INTERVAL_MS):
+		}
+
+		s.connection_keys_mutex.RLock()
+		player_count := uint(len(s.connection_keys))
+		s.connection_keys_mutex.RUnlock()
+
+		packet := Packet{}
+		packet.PacketType = PacketTypeLanAnnounce
+
+		data := LanAnnounceData{s.JoinCode(), player_count, s.LevelType() != LobbyLevel}
+		err := s.channel.Send(packet, data, &broadcast_addr)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			fmt.Println("error announcing game on LAN", err)
+		}
+	}
+}
+
+// LanBrowser collects the games announced on the local network
+type LanBrowser struct {
+	conn        *net.UDPConn
+	games       map[string]LanGame
+	games_mutex sync.RWMutex
+}
+
+// returns nil if we can't listen, which happens when another game on this machine already does
+func NewLanBrowser(port int) *LanBrowser {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4zero, Port: port})
+	if err != nil {
+		fmt.Println("LAN discovery is disabled:", err)
+		return nil
+	}
+
+	browser := LanBrowser{conn: conn, games: make(map[string]LanGame)}
+	go browser.listen()
+
+	return &browser
+}
+
+func (lb *LanBrowser) listen() {
+	buf := make([]byte, READ_BUFFER_SIZE)
+	for {
+		n, addr, err := lb.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			fmt.Println("error reading", err)
+			continue
+		}
+
+		packet, data, err := DeserializePacket(buf[:n])
+		if err != nil || packet.PacketType != PacketTypeLanAnnounce || CheckPacketVersion(packet) != nil {
+			continue
+		}
+
+		var announce LanAnnounceData
+		err = NewDecoder(data).Decode(&announce)
+		if err != nil {
+			fmt.Println("error decoding LAN announcement", err)
+			continue
+		}
+
+		lb.games_mutex.Lock()
+		lb.games[addr.String()] = LanGame{*addr, announce.Code, announce.PlayerCount, announce.Started, time.Now()}
+		lb.games_mutex.Unlock()
+	}
+}
+
+// the games we have heard from recently, sorted so the list doesn't jump around
+func (lb *LanBrowser) Games() []LanGame {
+	if lb == nil {
+		return nil
+	}
+
+	lb.games_mutex.Lock()
+	games := []LanGame{}
+	for key, game := range lb.games {
+		if time.Since(game.LastSeen) > time.Millisecond*LAN_GAME_TIMEOUT_MS {
+			delete(lb.games, key)
+			continue
+		}
+		games = append(games, game)
+	}
+	lb.games_mutex.Unlock()
+
+	sort.Slice(games, func(i, j int) bool {
+		return games[i].Addr.String() < games[j].Addr.String()
+	})
+	return games
+}
@@ -68,9 +68,15 @@ func (l *Level) generateObstacleMatrix() [][]bool {
 	return boolArray
 }
 
+// LoadLevel loads everything the game needs to show the level, see LoadLevelData
 func LoadLevel(level *Level, levelType LevelEnum) {
-	level.JoinWizard = nil
-	level.HostSmith = nil
+	LoadLevelData(level, levelType)
+	level.MapImage = renderMapImage(level.Map)
+}
+
+// LoadLevelData loads the map and its objects without rendering it, which is all the server needs
+func LoadLevelData(level *Level, levelType LevelEnum) {
+	*level = Level{}
 	var gameMap *tiled.Map
 	switch levelType {
 	case LobbyLevel:
@@ -98,28 +104,6 @@ func LoadLevel(level *Level, levelType LevelEnum) {
 
 	level.Map = gameMap
 
-	mapRenderer, err := render.NewRenderer(gameMap)
-
-	if err != nil {
-		panic(err)
-	}
-
-	// render it to an in memory image
-	err = mapRenderer.RenderVisibleLayers()
-
-	if err != nil {
-		panic(err)
-	}
-
-	var buff []byte
-	buffer := bytes.NewBuffer(buff)
-
-	mapRenderer.SaveAsPng(buffer)
-
-	im, err := png.Decode(buffer)
-
-	level.MapImage = ebiten.NewImageFromImage(im)
-
 	for _, object_group := range level.Map.ObjectGroups {
 		if object_group.Name == "Collision" {
 			level.Collisions = object_group.Objects
@@ -146,14 +130,7 @@ func LoadLevel(level *Level, levelType LevelEnum) {
 	}
 }
 
-func LoadPregameLevel() Level {
-	level := Level{}
-	gameMap, err := tiled.LoadFile("assets/Tiled/pregame_level.tmx")
-	if err != nil {
-		panic(err)
-	}
-	level.Map = gameMap
-
+func renderMapImage(gameMap *tiled.Map) *ebiten.Image {
 	mapRenderer, err := render.NewRenderer(gameMap)
 
 	if err != nil {
@@ -173,8 +150,21 @@ func LoadPregameLevel() Level {
 	mapRenderer.SaveAsPng(buffer)
 
 	im, err := png.Decode(buffer)
+	if err != nil {
+		panic(err)
+	}
+
+	return ebiten.NewImageFromImage(im)
+}
 
-	level.MapImage = ebiten.NewImageFromImage(im)
+func LoadPregameLevel() Level {
+	level := Level{}
+	gameMap, err := tiled.LoadFile("assets/Tiled/pregame_level.tmx")
+	if err != nil {
+		panic(err)
+	}
+	level.Map = gameMap
+	level.MapImage = renderMapImage(gameMap)
 
 	for _, object_group := range level.Map.ObjectGroups {
 		if object_group.Name == "Collision" {
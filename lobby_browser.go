@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// keeps the answer in a single datagram, the mediation server doesn't fragment
+	LOBBY_LIST_LIMIT          = 20
+	LOBBY_LIST_TIMEOUT_MS     = 1000
+	LOBBY_REFRESH_INTERVAL_MS = 3000
+	// longer host names are cut off by the mediation server, in bytes
+	MAX_HOST_NAME_LENGTH = 32
+)
+
+// what a host tells the mediation server about itself in every keepalive
+type HostMetadata struct {
+	HostName    string
+	PlayerCount uint
+	ReadyCount  uint
+	Level       LevelEnum
+}
+
+// a public lobby as listed by the mediation server
+type LobbyInfo struct {
+	Code        string
+	HostName    string
+	PlayerCount uint
+	ReadyCount  uint
+	Level       LevelEnum
+	Version     uint16
+}
+
+type LobbyListData struct {
+	Lobbies []LobbyInfo
+}
+
+func DefaultHostName() string {
+	name, err := os.Hostname()
+	if err != nil || name == "" {
+		return "anonymous"
+	}
+	return name
+}
+
+// TruncateHostName cuts name down to MAX_HOST_NAME_LENGTH bytes without splitting a character
+func TruncateHostName(name string) string {
+	if len(name) <= MAX_HOST_NAME_LENGTH {
+		return name
+	}
+	name = name[:MAX_HOST_NAME_LENGTH]
+	for len(name) > 0 && !utf8.ValidString(name) {
+		name = name[:len(name)-1]
+	}
+	return name
+}
+
+func (s *Server) HostMetadata() HostMetadata {
+	s.connection_keys_mutex.RLock()
+	var readyCount uint = 0
+	for _, conn := range s.connection_keys {
+		player, ok := loadFromSyncMap[ConnectedPlayer](conn, &s.connections)
+		if ok && player.IsReady {
+			readyCount++
+		}
+	}
+	playerCount := uint(len(s.connection_keys))
+	s.connection_keys_mutex.RUnlock()
+
+	return HostMetadata{s.host_name, playerCount, readyCount, s.LevelType()}
+}
+
+// FetchLobbies asks the mediation server for the lobbies that haven't started yet
+func FetchLobbies(config Config) ([]LobbyInfo, error) {
+	mediation_addr, err := config.ResolveMediationAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	packet := Packet{}
+	packet.PacketType = PacketTypeLobbyList
+
+	raw_data, err := SerializePacket(packet, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.WriteToUDP(raw_data, mediation_addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond * LOBBY_LIST_TIMEOUT_MS))
+
+	buf := make([]byte, READ_BUFFER_SIZE)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		if addr.String() != mediation_addr.String() {
+			continue
+		}
+
+		packet, data, err := DeserializePacket(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+
+		if packet.PacketType == PacketTypeError {
+			var errorData ErrorData
+			err = NewDecoder(data).Decode(&errorData)
+			if err != nil {
+				return nil, err
+			}
+			return nil, errorData.Err()
+		}
+
+		if packet.PacketType != PacketTypeLobbyList {
+			continue
+		}
+
+		var list LobbyListData
+		err = NewDecoder(data).Decode(&list)
+		if err != nil {
+			return nil, err
+		}
+		return list.Lobbies, nil
+	}
+}
+
+// LobbyBrowser keeps a recent copy of the public lobby list, fetched in the background
+// so the game never waits on the mediation server
+type LobbyBrowser struct {
+	config        Config
+	lobbies       []LobbyInfo
+	lobbies_mutex sync.RWMutex
+	last_refresh  time.Time
+	refreshing    bool
+}
+
+func NewLobbyBrowser(config Config) *LobbyBrowser {
+	return &LobbyBrowser{config: config}
+}
+
+// Refresh starts fetching the list again unless that happened recently
+func (lb *LobbyBrowser) Refresh() {
+	lb.lobbies_mutex.Lock()
+	if lb.refreshing || time.Since(lb.last_refresh) < time.Millisecond*LOBBY_REFRESH_INTERVAL_MS {
+		lb.lobbies_mutex.Unlock()
+		return
+	}
+	lb.refreshing = true
+	lb.lobbies_mutex.Unlock()
+
+	go func() {
+		lobbies, err := FetchLobbies(lb.config)
+		if err != nil {
+			fmt.Println("could not fetch lobbies", err)
+		}
+
+		lb.lobbies_mutex.Lock()
+		if err == nil {
+			lb.lobbies = lobbies
+		}
+		lb.refreshing = false
+		lb.last_refresh = time.Now()
+		lb.lobbies_mutex.Unlock()
+	}()
+}
+
+func (lb *LobbyBrowser) Lobbies() []LobbyInfo {
+	lb.lobbies_mutex.RLock()
+	defer lb.lobbies_mutex.RUnlock()
+	return lb.lobbies
+}
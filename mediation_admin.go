@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// MediationStats counts what the mediation server has been up to since it started.
+// Everything is atomic as the admin endpoint reads it from its own goroutines
+type MediationStats struct {
+	started_at time.Time
+
+	packets       [PacketTypeCount]atomic.Uint64
+	decode_errors atomic.Uint64
+	rate_limited  atomic.Uint64
+
+	hosts_registered atomic.Uint64
+	hosts_refused    atomic.Uint64
+	host_timeouts    atomic.Uint64
+	matches          atomic.Uint64
+	version_errors   atomic.Uint64
+	// every match that didn't end up asking for a relay has punched through
+	relay_fallbacks atomic.Uint64
+	relayed_packets atomic.Uint64
+	relay_refused   atomic.Uint64
+}
+
+func NewMediationStats() *MediationStats {
+	return &MediationStats{started_at: time.Now()}
+}
+
+func (ms *MediationStats) CountPacket(packetType PacketType) {
+	if packetType < PacketTypeCount {
+		ms.packets[packetType].Add(1)
+	}
+}
+
+// MediationReport is what the admin endpoint answers with
+type MediationReport struct {
+	UptimeSeconds   int64             `json:"uptime_seconds"`
+	ActiveLobbies   int               `json:"active_lobbies"`
+	StartedLobbies  int               `json:"started_lobbies"`
+	RelaySessions   int               `json:"relay_sessions"`
+	HostsRegistered uint64            `json:"hosts_registered"`
+	HostsRefused    uint64            `json:"hosts_refused"`
+	HostTimeouts    uint64            `json:"host_timeouts"`
+	Matches         uint64            `json:"matches"`
+	VersionErrors   uint64            `json:"version_errors"`
+	RelayFallbacks  uint64            `json:"relay_fallbacks"`
+	RelayedPackets  uint64            `json:"relayed_packets"`
+	RelayRefused    uint64            `json:"relay_refused"`
+	DecodeErrors    uint64            `json:"decode_errors"`
+	RateLimited     uint64            `json:"rate_limited"`
+	Packets         map[string]uint64 `json:"packets"`
+	Lobbies         []LobbyInfo       `json:"lobbies"`
+}
+
+func (ms *MediationStats) Report(hosts *HostRegistry, relays *RelaySessions) MediationReport {
+	active, started := hosts.Counts()
+
+	report := MediationReport{
+		UptimeSeconds:   int64(time.Since(ms.started_at).Seconds()),
+		ActiveLobbies:   active,
+		StartedLobbies:  started,
+		RelaySessions:   relays.Count(),
+		HostsRegistered: ms.hosts_registered.Load(),
+		HostsRefused:    ms.hosts_refused.Load(),
+		HostTimeouts:    ms.host_timeouts.Load(),
+		Matches:         ms.matches.Load(),
+		VersionErrors:   ms.version_errors.Load(),
+		RelayFallbacks:  ms.relay_fallbacks.Load(),
+		RelayedPackets:  ms.relayed_packets.Load(),
+		RelayRefused:    ms.relay_refused.Load(),
+		DecodeErrors:    ms.decode_errors.Load(),
+		RateLimited:     ms.rate_limited.Load(),
+		Packets:         make(map[string]uint64),
+		Lobbies:         hosts.Lobbies().Lobbies,
+	}
+
+	for packetType := PacketType(1); packetType < PacketTypeCount; packetType++ {
+		report.Packets[packetType.String()] = ms.packets[packetType].Load()
+	}
+
+	return report
+}
+
+// Prometheus writes the report in the prometheus text format
+func (r MediationReport) Prometheus() string {
+	var b strings.Builder
+
+	metric := func(name string, kind string, help string, value any) {
+		fmt.Fprintf(&b, "# HELP gmtk_mediation_%s %s\n", name, help)
+		fmt.Fprintf(&b, "# TYPE gmtk_mediation_%s %s\n", name, kind)
+		fmt.Fprintf(&b, "gmtk_mediation_%s %v\n", name, value)
+	}
+
+	metric("uptime_seconds", "gauge", "Seconds since the mediation server started.", r.UptimeSeconds)
+	metric("active_lobbies", "gauge", "Lobbies that can still be joined.", r.ActiveLobbies)
+	metric("started_lobbies", "gauge", "Lobbies whose game has started.", r.StartedLobbies)
+	metric("relay_sessions", "gauge", "Pairs currently relayed.", r.RelaySessions)
+	metric("hosts_registered_total", "counter", "Hosts that were listed.", r.HostsRegistered)
+	metric("hosts_refused_total", "counter", "Hosts that were refused a listing.", r.HostsRefused)
+	metric("host_timeouts_total", "counter", "Hosts dropped for not sending keepalives.", r.HostTimeouts)
+	metric("matches_total", "counter", "Players introduced to a host.", r.Matches)
+	metric("version_errors_total", "counter", "Players refused for having another protocol version than their host.", r.VersionErrors)
+	metric("relay_fallbacks_total", "counter", "Matches that could not punch through and asked for a relay.", r.RelayFallbacks)
+	metric("relayed_packets_total", "counter", "Datagrams passed along between relayed pairs.", r.RelayedPackets)
+	metric("relay_refused_total", "counter", "Relay requests that were refused.", r.RelayRefused)
+	metric("decode_errors_total", "counter", "Packets that could not be read.", r.DecodeErrors)
+	metric("rate_limited_total", "counter", "Packets dropped by the per ip rate limit.", r.RateLimited)
+
+	b.WriteString("# HELP gmtk_mediation_packets_total Packets received by type.\n")
+	b.WriteString("# TYPE gmtk_mediation_packets_total counter\n")
+	for packetType := PacketType(1); packetType < PacketTypeCount; packetType++ {
+		fmt.Fprintf(&b, "gmtk_mediation_packets_total{type=%q} %d\n", packetType.String(), r.Packets[packetType.String()])
+	}
+
+	return b.String()
+}
+
+// ServeMediationAdmin serves the report as json on /stats and for prometheus on /metrics.
+// It is meant to be bound to localhost, there is no authentication
+func ServeMediationAdmin(addr string, stats *MediationStats, hosts *HostRegistry, relays *RelaySessions, logger *slog.Logger) {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(stats.Report(hosts, relays))
+		if err != nil {
+			logger.Warn("error writing stats", "err", err)
+		}
+	})
+
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fmt.Fprint(w, stats.Report(hosts, relays).Prometheus())
+	})
+
+	logger.Info("admin endpoint listening", "addr", addr)
+	err := http.ListenAndServe(addr, mux)
+	if err != nil {
+		logger.Error("admin endpoint stopped", "err", err)
+	}
+}
+
+func NewMediationLogger(format string) *slog.Logger {
+	if format == "json" {
+		return slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	}
+	return slog.New(slog.NewTextHandler(os.Stdout, nil))
+}
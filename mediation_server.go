@@ -1,67 +1,352 @@
 package main
 
 import (
-	"bytes"
-	"encoding/gob"
-	"fmt"
+	"errors"
+	"log/slog"
 	"net"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
+const (
+	// hosts that haven't sent a keepalive in this long are dropped
+	HOST_TIMEOUT_MS = 7000
+	// no matter how many addresses ask, the mediation server never keeps more than this many lobbies
+	MAX_HOSTS = 1024
+	// a single ip can host a few games at once, but not fill up the whole list
+	MAX_HOSTS_PER_IP = 4
+	// how often we try to find a free key before giving up
+	MAX_KEY_ATTEMPTS = 64
+
+	// every ip gets this many packets a second, with room for a short burst.
+	// Relayed packets don't count, they only go between pairs we have agreed to relay for
+	RATE_LIMIT_PER_SECOND = 20
+	RATE_LIMIT_BURST      = 40
+	// ips we keep rate limits for, full buckets are the first to go when there are more
+	MAX_RATE_LIMITED_IPS = 4096
+	MAX_RELAY_SESSIONS   = 1024
+)
+
 type Hosts struct {
 	Keyword string
 	Addr    *net.UDPAddr
 	Time    int64
+	Version uint16
+	// started hosts are kept around so their players can find them again after dropping out
+	Started  bool
+	Metadata HostMetadata
+}
+
+// HostRegistry is every lobby the mediation server knows about. The packet loop and the
+// timeout loop both use it, so everything goes through hosts_mutex
+type HostRegistry struct {
+	hosts       map[string]Hosts
+	hosts_mutex sync.Mutex
+}
+
+func NewHostRegistry() *HostRegistry {
+	return &HostRegistry{hosts: make(map[string]Hosts)}
+}
+
+// Register lists addr under key, or under a freshly generated key if someone else already has it.
+// An address only ever has one lobby, registering again replaces the old one
+func (hr *HostRegistry) Register(key string, addr net.UDPAddr, version uint16) (string, error) {
+	hr.hosts_mutex.Lock()
+	defer hr.hosts_mutex.Unlock()
+
+	from_ip := 0
+	for existing_key, host := range hr.hosts {
+		if host.Addr.String() == addr.String() {
+			if existing_key == key {
+				host.Time = time.Now().UnixMilli()
+				hr.hosts[key] = host
+				return key, nil
+			}
+			delete(hr.hosts, existing_key)
+			continue
+		}
+		if host.Addr.IP.Equal(addr.IP) {
+			from_ip++
+		}
+	}
+
+	if from_ip >= MAX_HOSTS_PER_IP || len(hr.hosts) >= MAX_HOSTS {
+		return "", ErrTooManyHosts
+	}
+
+	// keys are only ever namespaced codes, anything else gets a code of our choosing
+	_, taken := hr.hosts[key]
+	if taken || !strings.HasPrefix(key, JOIN_KEY_PREFIX) || len(key) == len(JOIN_KEY_PREFIX) {
+		key = ""
+		for i := 0; i < MAX_KEY_ATTEMPTS; i++ {
+			candidate := JOIN_KEY_PREFIX + NewJoinCode()
+			if _, ok := hr.hosts[candidate]; !ok {
+				key = candidate
+				break
+			}
+		}
+		if key == "" {
+			return "", ErrTooManyHosts
+		}
+	}
+
+	hr.hosts[key] = Hosts{key, &addr, time.Now().UnixMilli(), version, false, HostMetadata{}}
+	return key, nil
+}
+
+func (hr *HostRegistry) Lookup(key string) (Hosts, bool) {
+	hr.hosts_mutex.Lock()
+	defer hr.hosts_mutex.Unlock()
+	host, ok := hr.hosts[key]
+	return host, ok
+}
+
+// KeepAlive refreshes the lobby addr owns, metadata is nil if the keepalive didn't carry any
+func (hr *HostRegistry) KeepAlive(addr net.UDPAddr, metadata *HostMetadata) {
+	hr.hosts_mutex.Lock()
+	defer hr.hosts_mutex.Unlock()
+
+	for key, host := range hr.hosts {
+		if host.Addr.String() == addr.String() {
+			host.Time = time.Now().UnixMilli()
+			if metadata != nil {
+				host.Metadata = *metadata
+				// they all end up in the same lobby list datagram
+				host.Metadata.HostName = TruncateHostName(metadata.HostName)
+			}
+			hr.hosts[key] = host
+		}
+	}
+}
+
+// Start marks the lobby as started, only the address that registered it may do so
+func (hr *HostRegistry) Start(key string, addr net.UDPAddr) bool {
+	hr.hosts_mutex.Lock()
+	defer hr.hosts_mutex.Unlock()
+
+	host, ok := hr.hosts[key]
+	if !ok || host.Addr.String() != addr.String() {
+		return false
+	}
+	host.Started = true
+	hr.hosts[key] = host
+	return true
+}
+
+// Remove takes the lobby off the list, only the address that registered it may do so
+func (hr *HostRegistry) Remove(key string, addr net.UDPAddr) bool {
+	hr.hosts_mutex.Lock()
+	defer hr.hosts_mutex.Unlock()
+
+	host, ok := hr.hosts[key]
+	if !ok || host.Addr.String() != addr.String() {
+		return false
+	}
+	delete(hr.hosts, key)
+	return true
 }
 
-func timeoutStaleConnections(keyword_map *map[string]Hosts) {
-	for key, value := range map[string]Hosts(*keyword_map) {
-		if time.Now().UnixMilli()-value.Time > 7000 {
-			fmt.Printf("%s user timed out using '%s' connection key\n", value.Addr, value.Keyword)
-			delete(*keyword_map, key)
+// TimeoutStale returns the hosts it has dropped
+func (hr *HostRegistry) TimeoutStale() []Hosts {
+	hr.hosts_mutex.Lock()
+	defer hr.hosts_mutex.Unlock()
+
+	timed_out := []Hosts{}
+	for key, value := range hr.hosts {
+		if time.Now().UnixMilli()-value.Time > HOST_TIMEOUT_MS {
+			timed_out = append(timed_out, value)
+			delete(hr.hosts, key)
+		}
+	}
+	return timed_out
+}
+
+// Counts returns how many lobbies can still be joined and how many have started
+func (hr *HostRegistry) Counts() (active int, started int) {
+	hr.hosts_mutex.Lock()
+	defer hr.hosts_mutex.Unlock()
+
+	for _, host := range hr.hosts {
+		if host.Started {
+			started++
+		} else {
+			active++
 		}
 	}
+	return active, started
 }
 
-func RunMediationServer() {
-	server_addr, err := net.ResolveUDPAddr("udp", ":8080")
+// Lobbies lists the hosts that can still be joined, at most LOBBY_LIST_LIMIT of them
+// and no more than fit in a single datagram
+func (hr *HostRegistry) Lobbies() LobbyListData {
+	hr.hosts_mutex.Lock()
+	defer hr.hosts_mutex.Unlock()
+
+	keys := []string{}
+	for key, host := range hr.hosts {
+		if !host.Started {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	list := LobbyListData{}
+	// the header and the lobby count, which fits a byte as there are never more than LOBBY_LIST_LIMIT
+	size := HEADER_SIZE + 1
+	for _, key := range keys[:min(len(keys), LOBBY_LIST_LIMIT)] {
+		host := hr.hosts[key]
+		lobby := LobbyInfo{
+			strings.TrimPrefix(host.Keyword, JOIN_KEY_PREFIX),
+			host.Metadata.HostName,
+			host.Metadata.PlayerCount,
+			host.Metadata.ReadyCount,
+			host.Metadata.Level,
+			host.Version,
+		}
+
+		// a list that doesn't fit a datagram can't be read by anyone
+		w := BinaryWriter{}
+		lobby.EncodeBinary(&w)
+		size += len(w.Bytes())
+		if size > MAX_DATAGRAM_SIZE {
+			break
+		}
+		list.Lobbies = append(list.Lobbies, lobby)
+	}
+	return list
+}
+
+type rateBucket struct {
+	tokens      float64
+	last_refill time.Time
+}
+
+// RateLimiter is a token bucket per ip, only used from the mediation server's packet loop
+type RateLimiter struct {
+	buckets map[string]*rateBucket
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{buckets: make(map[string]*rateBucket)}
+}
+
+func (rl *RateLimiter) Allow(ip net.IP) bool {
+	now := time.Now()
+
+	bucket, ok := rl.buckets[ip.String()]
+	if !ok {
+		if len(rl.buckets) >= MAX_RATE_LIMITED_IPS {
+			rl.dropFull(now)
+		}
+		if len(rl.buckets) >= MAX_RATE_LIMITED_IPS {
+			return false
+		}
+		bucket = &rateBucket{RATE_LIMIT_BURST, now}
+		rl.buckets[ip.String()] = bucket
+	}
+
+	bucket.tokens = min(RATE_LIMIT_BURST, bucket.tokens+now.Sub(bucket.last_refill).Seconds()*RATE_LIMIT_PER_SECOND)
+	bucket.last_refill = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// forgets the ips that have been quiet for long enough to have a full bucket again
+func (rl *RateLimiter) dropFull(now time.Time) {
+	for key, bucket := range rl.buckets {
+		if bucket.tokens+now.Sub(bucket.last_refill).Seconds()*RATE_LIMIT_PER_SECOND >= RATE_LIMIT_BURST {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+func sendMediationPacket(conn Transport, logger *slog.Logger, packetType PacketType, data any, addr *net.UDPAddr) {
+	packet := Packet{}
+	packet.PacketType = packetType
+	serialized_packet, err := SerializePacket(packet, data)
 	if err != nil {
-		fmt.Println("Error resolving address:", err)
+		logger.Error("error during serialization", "type", packetType, "err", err)
 		return
 	}
 
-	var host_map map[string]Hosts
-	host_map = make(map[string]Hosts)
+	_, err = conn.WriteToUDP(serialized_packet, addr)
+	if err != nil {
+		logger.Warn("error during sending packet", "type", packetType, "addr", addr.String(), "err", err)
+	}
+}
+
+func RunMediationServer(config Config) {
+	server_addr := config.MediationListenAddr()
+	logger := NewMediationLogger(config.LogFormat)
 
-	conn, err := net.ListenUDP("udp", server_addr)
+	conn, err := ListenTransport(config, server_addr)
 	if err != nil {
-		fmt.Println("Error listening:", err)
+		logger.Error("error listening", "addr", server_addr.String(), "err", err)
 		return
 	}
 
-	fmt.Println("Listening")
+	logger.Info("listening", "addr", server_addr.String(), "relay", config.Relay)
+	ServeMediation(config, conn, logger)
+}
+
+// ServeMediation answers hosts and clients on conn until it is closed
+func ServeMediation(config Config, conn Transport, logger *slog.Logger) {
 	defer conn.Close()
 
+	hosts := NewHostRegistry()
+	limiter := NewRateLimiter()
+	stats := NewMediationStats()
+
 	packet_channel := make(chan PacketData)
+	// closed once conn is
+	done := make(chan struct{})
+	relays := NewRelaySessions()
+
+	if config.AdminAddr != "" {
+		go ServeMediationAdmin(config.AdminAddr, stats, hosts, relays, logger)
+	}
 
 	go func() {
 		for {
-			timeoutStaleConnections(&host_map)
-			time.Sleep(time.Second * 1)
+			for _, host := range hosts.TimeoutStale() {
+				stats.host_timeouts.Add(1)
+				logger.Info("host timed out", "addr", host.Addr.String(), "key", host.Keyword, "started", host.Started)
+			}
+			for _, pair := range relays.DropStale() {
+				logger.Info("closing relay", "pair", pair)
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Second * 1):
+			}
 		}
 	}()
 
 	go func() {
-		buf := make([]byte, 1024)
+		buf := make([]byte, READ_BUFFER_SIZE)
 		for {
 			n, addr, err := conn.ReadFromUDP(buf)
 			if err != nil {
-				fmt.Println("error reading", err)
+				if errors.Is(err, net.ErrClosed) {
+					close(done)
+					return
+				}
+				logger.Warn("error reading", "err", err)
+				continue
 			}
 
 			packet, data, err := DeserializePacket(buf[:n])
 			if err != nil {
-				fmt.Println("error reading", err)
+				stats.decode_errors.Add(1)
+				logger.Debug("dropping invalid packet", "addr", addr.String(), "err", err)
+				continue
 			}
 
 			packet_data := PacketData{packet, data, *addr}
@@ -71,73 +356,154 @@ func RunMediationServer() {
 
 	for {
 		select {
+		case <-done:
+			return
 		case packet_data := <-packet_channel:
-			dec := gob.NewDecoder(bytes.NewReader(packet_data.Data))
+			stats.CountPacket(packet_data.Packet.PacketType)
+
+			if packet_data.Packet.PacketType != PacketTypeRelay && !limiter.Allow(packet_data.Addr.IP) {
+				stats.rate_limited.Add(1)
+				continue
+			}
+
+			dec := NewDecoder(packet_data.Data)
 			switch packet_data.Packet.PacketType {
 			case PacketTypeKeepAlive:
-				// refreshing timeout
-				for key, value := range host_map {
-					if value.Addr.String() == packet_data.Addr.String() {
-						value.Time = time.Now().UnixMilli()
-						host_map[key] = value
-					}
+				var metadata HostMetadata
+				if dec.Decode(&metadata) == nil {
+					hosts.KeepAlive(packet_data.Addr, &metadata)
+				} else {
+					hosts.KeepAlive(packet_data.Addr, nil)
 				}
 
+			case PacketTypeLobbyList:
+				sendMediationPacket(conn, logger, PacketTypeLobbyList, hosts.Lobbies(), &packet_data.Addr)
+
 			case PacketTypeMatchHost:
 				var inner_data ReconcilliationData
 				err := dec.Decode(&inner_data)
 				if err != nil {
-					fmt.Println("error during decoding", err)
+					stats.decode_errors.Add(1)
+					logger.Debug("error during decoding", "type", packet_data.Packet.PacketType, "err", err)
+					break
 				}
 
-				// if already exists
-				if host_map[inner_data.Name].Keyword != "" {
+				key, err := hosts.Register(inner_data.Name, packet_data.Addr, packet_data.Packet.Version)
+				if err != nil {
+					stats.hosts_refused.Add(1)
+					logger.Warn("refused to list host", "addr", packet_data.Addr.String(), "err", err)
+					sendMediationPacket(conn, logger, PacketTypeError, ErrorData{ErrorCodeTooManyHosts, "too many lobbies, try again later", PROTOCOL_VERSION}, &packet_data.Addr)
 					break
 				}
 
-				host_map[inner_data.Name] = Hosts{inner_data.Name, &packet_data.Addr, time.Now().UnixMilli()}
-				fmt.Println("added new host: ", inner_data)
+				stats.hosts_registered.Add(1)
+				logger.Info("added new host", "addr", packet_data.Addr.String(), "key", key, "requested", inner_data.Name, "version", packet_data.Packet.Version)
+				sendMediationPacket(conn, logger, PacketTypeMatchHosted, ReconcilliationData{key}, &packet_data.Addr)
 
 			case PacketTypeMatchFind:
 				var inner_data ReconcilliationData
 				err := dec.Decode(&inner_data)
 				if err != nil {
-					fmt.Println("error during decoding", err)
-				}
-
-				// if already exists
-				if host_map[inner_data.Name].Keyword != "" {
-					fmt.Println("match found!")
-					packet := Packet{}
-					packet.PacketType = PacketTypeMatchConnect
-					data := packet_data.Addr
-					serialized_packet, err := SerializePacket(packet, data)
-					if err != nil {
-						fmt.Println("error during serialization", err)
-					}
-
-					host_addr := host_map[inner_data.Name].Addr
-					_, err = conn.WriteToUDP(serialized_packet, host_addr)
-					if err != nil {
-						fmt.Println("error during sending packet", err)
-					}
-
-					data = *host_map[inner_data.Name].Addr
-					serialized_packet, err = SerializePacket(packet, data)
-					if err != nil {
-						fmt.Println("error during serialization", err)
-					}
-					conn.WriteToUDP(serialized_packet, &packet_data.Addr)
+					stats.decode_errors.Add(1)
+					logger.Debug("error during decoding", "type", packet_data.Packet.PacketType, "err", err)
+					break
 				}
+
+				host, ok := hosts.Lookup(inner_data.Name)
+				if !ok {
+					break
+				}
+
+				if host.Version != packet_data.Packet.Version {
+					stats.version_errors.Add(1)
+					logger.Info("version mismatch", "addr", packet_data.Addr.String(), "key", host.Keyword, "version", packet_data.Packet.Version, "host_version", host.Version)
+					sendMediationPacket(conn, logger, PacketTypeError, NewVersionMismatchError(packet_data.Packet.Version), &packet_data.Addr)
+					break
+				}
+
+				stats.matches.Add(1)
+				logger.Info("match found", "addr", packet_data.Addr.String(), "key", host.Keyword, "host", host.Addr.String())
+				sendMediationPacket(conn, logger, PacketTypeMatchConnect, packet_data.Addr, host.Addr)
+				sendMediationPacket(conn, logger, PacketTypeMatchConnect, *host.Addr, &packet_data.Addr)
+
+			case PacketTypeRelayStart:
+				var inner_data ReconcilliationData
+				err := dec.Decode(&inner_data)
+				if err != nil {
+					stats.decode_errors.Add(1)
+					logger.Debug("error during decoding", "type", packet_data.Packet.PacketType, "err", err)
+					break
+				}
+
+				host, ok := hosts.Lookup(inner_data.Name)
+				if !ok {
+					break
+				}
+
+				if !config.Relay {
+					stats.relay_refused.Add(1)
+					sendMediationPacket(conn, logger, PacketTypeError, ErrorData{ErrorCodeRelayDisabled, "this mediation server does not relay", PROTOCOL_VERSION}, &packet_data.Addr)
+					break
+				}
+
+				// clients ask a few times in case one gets lost, only the first one is a new fallback
+				if relays.Allow(&packet_data.Addr, host.Addr) {
+					break
+				}
+
+				if !relays.Open(&packet_data.Addr, host.Addr) {
+					stats.relay_refused.Add(1)
+					logger.Warn("too many relays", "addr", packet_data.Addr.String(), "key", host.Keyword)
+					break
+				}
+				stats.relay_fallbacks.Add(1)
+				logger.Info("relaying", "addr", packet_data.Addr.String(), "key", host.Keyword, "host", host.Addr.String())
+
+			case PacketTypeRelay:
+				var relay RelayData
+				err := dec.Decode(&relay)
+				if err != nil {
+					stats.decode_errors.Add(1)
+					logger.Debug("error during decoding", "type", packet_data.Packet.PacketType, "err", err)
+					break
+				}
+
+				if !relays.Allow(&packet_data.Addr, &relay.Peer) {
+					break
+				}
+
+				// the peer sees who the datagram is from instead of who it is for
+				stats.relayed_packets.Add(1)
+				sendMediationPacket(conn, logger, PacketTypeRelay, RelayData{packet_data.Addr, relay.Datagram}, &relay.Peer)
+
 			case PacketTypeMatchStart:
 				var inner_data ReconcilliationData
 				err := dec.Decode(&inner_data)
 				if err != nil {
-					fmt.Println("error during decoding", err)
+					stats.decode_errors.Add(1)
+					logger.Debug("error during decoding", "type", packet_data.Packet.PacketType, "err", err)
+					break
+				}
+
+				if !hosts.Start(inner_data.Name, packet_data.Addr) {
+					logger.Warn("start from someone that isn't the host", "addr", packet_data.Addr.String(), "key", inner_data.Name)
+					break
 				}
 
-				fmt.Printf("%s's server has started, and has been removed from eligible lobbies\n", packet_data.Addr.String())
-				delete(host_map, inner_data.Name)
+				// the host only lets players with a session back in once it has started
+				logger.Info("host started, only reconnecting players can join", "addr", packet_data.Addr.String(), "key", inner_data.Name)
+
+			case PacketTypeDisconnect:
+				var inner_data ReconcilliationData
+				err := dec.Decode(&inner_data)
+				if err != nil {
+					stats.decode_errors.Add(1)
+					break
+				}
+
+				if hosts.Remove(inner_data.Name, packet_data.Addr) {
+					logger.Info("host stopped", "addr", packet_data.Addr.String(), "key", inner_data.Name)
+				}
 			}
 		}
 	}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+const (
+	// datagrams waiting to be read before a MemoryTransport starts dropping them, like a full socket buffer would
+	MEMORY_TRANSPORT_BUFFER = 1024
+	// where MemoryNetwork starts handing out ports to transports that didn't ask for one
+	MEMORY_TRANSPORT_FIRST_PORT = 40000
+)
+
+// MemoryNetwork connects MemoryTransports to each other without any sockets, so a server and its
+// clients can run in a single process. Datagrams to addresses nobody listens on are lost, like with UDP
+type MemoryNetwork struct {
+	transports map[string]*MemoryTransport
+	next_port  int
+	mutex      sync.Mutex
+}
+
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		transports: make(map[string]*MemoryTransport),
+		next_port:  MEMORY_TRANSPORT_FIRST_PORT,
+	}
+}
+
+// Listen opens a transport on addr, nil or port 0 picks a free port on 127.0.0.1
+func (mn *MemoryNetwork) Listen(addr *net.UDPAddr) (*MemoryTransport, error) {
+	mn.mutex.Lock()
+	defer mn.mutex.Unlock()
+
+	local := net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	if addr != nil {
+		local = *addr
+		if local.IP == nil || local.IP.IsUnspecified() {
+			local.IP = net.IPv4(127, 0, 0, 1)
+		}
+	}
+
+	if local.Port == 0 {
+		for {
+			local.Port = mn.next_port
+			mn.next_port++
+			if _, taken := mn.transports[local.String()]; !taken {
+				break
+			}
+		}
+	}
+
+	if _, taken := mn.transports[local.String()]; taken {
+		return nil, fmt.Errorf("%s is already in use", local.String())
+	}
+
+	transport := &MemoryTransport{
+		network: mn,
+		addr:    local,
+		inbox:   make(chan delayedDatagram, MEMORY_TRANSPORT_BUFFER),
+		closed:  make(chan struct{}),
+	}
+	mn.transports[local.String()] = transport
+	return transport, nil
+}
+
+func (mn *MemoryNetwork) lookup(addr *net.UDPAddr) *MemoryTransport {
+	mn.mutex.Lock()
+	defer mn.mutex.Unlock()
+	return mn.transports[addr.String()]
+}
+
+func (mn *MemoryNetwork) remove(transport *MemoryTransport) {
+	mn.mutex.Lock()
+	defer mn.mutex.Unlock()
+	if mn.transports[transport.addr.String()] == transport {
+		delete(mn.transports, transport.addr.String())
+	}
+}
+
+// MemoryTransport is a Transport on a MemoryNetwork
+type MemoryTransport struct {
+	network *MemoryNetwork
+	addr    net.UDPAddr
+	inbox   chan delayedDatagram
+
+	closed     chan struct{}
+	close_once sync.Once
+}
+
+func (mt *MemoryTransport) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	select {
+	case datagram := <-mt.inbox:
+		return copy(b, datagram.data), datagram.addr, nil
+	case <-mt.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (mt *MemoryTransport) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	select {
+	case <-mt.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	to := mt.network.lookup(addr)
+	if to == nil {
+		return len(b), nil
+	}
+
+	data := make([]byte, len(b))
+	copy(data, b)
+	from := mt.addr
+
+	select {
+	case to.inbox <- delayedDatagram{data: data, addr: &from}:
+	default:
+		// nobody is reading, it is dropped like it would be on a real socket
+	}
+	return len(b), nil
+}
+
+func (mt *MemoryTransport) Close() error {
+	err := net.ErrClosed
+	mt.close_once.Do(func() {
+		close(mt.closed)
+		mt.network.remove(mt)
+		err = nil
+	})
+	return err
+}
+
+func (mt *MemoryTransport) LocalAddr() net.Addr {
+	addr := mt.addr
+	return &addr
+}
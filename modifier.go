@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"image/color"
+	"slices"
 
 	"github.com/hajimehoshi/ebiten/v2"
 	"github.com/hajimehoshi/ebiten/v2/text/v2"
@@ -11,7 +12,7 @@ import (
 type ModifierCalcType int
 type ModifierType int
 
-var BOONSPRITES = []*ebiten.Image{GetSpriteByID(89), GetSpriteByID(90), GetSpriteByID(91)}
+var BOONSPRITES []*ebiten.Image
 
 const (
 	ModifierCalcTypeMulti ModifierCalcType = iota
@@ -117,6 +118,10 @@ func (m *Modifiers) GetModifiedPlayerValue(valueType ModifierType) float64 {
 	return getModifiedValue(valueType, m.Player)
 }
 
+func (m *Modifiers) Equals(other Modifiers) bool {
+	return slices.Equal(m.Monster, other.Monster) && slices.Equal(m.Player, other.Player)
+}
+
 func (m *Modifiers) Add(newModifiers Modifiers) {
 	m.Monster = append(m.Monster, newModifiers.Monster...)
 	m.Player = append(m.Player, newModifiers.Player...)
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"math"
+
+	"github.com/hajimehoshi/ebiten/v2"
+)
+
+const (
+	// in frames, like everything else in the movement rules
+	ROLL_COOLDOWN = 100
+	// inputs the client keeps around until the server has acknowledged them
+	MAX_PENDING_INPUTS = 120
+	// every input update resends everything that hasn't been acknowledged, up to this many
+	MAX_INPUTS_PER_PACKET = 30
+	// how far we let the prediction drift from the server before we snap back
+	RECONCILE_EPSILON = 0.01
+	// the server simulates at most one input per frame, plus a burst for packets arriving in clumps
+	INPUT_FRAMES_PER_SECOND = 60
+	MAX_INPUT_BURST         = 30
+)
+
+// what the player pressed during a single frame, numbered so the server can tell us which it has applied
+type PlayerInput struct {
+	Sequence uint32
+	Up       bool
+	Down     bool
+	Left     bool
+	Right    bool
+	Roll     bool
+}
+
+// the part of a player that SimulateMovement changes
+type MovementState struct {
+	Position     Position
+	RollDuration float64
+	RollCooldown float64
+}
+
+func ReadPlayerInput() PlayerInput {
+	return PlayerInput{
+		Up:    ebiten.IsKeyPressed(ebiten.KeyW),
+		Down:  ebiten.IsKeyPressed(ebiten.KeyS),
+		Left:  ebiten.IsKeyPressed(ebiten.KeyA),
+		Right: ebiten.IsKeyPressed(ebiten.KeyD),
+		Roll:  ebiten.IsKeyPressed(ebiten.KeySpace),
+	}
+}
+
+func (s MovementState) IsRolling() bool {
+	return s.RollDuration != 0
+}
+
+// SimulateMovement moves a player by a single frame of input. The client predicts with it and the
+// server decides with it, so both have to come to the same result from the same inputs.
+// speed already includes the speed modifiers, ghosts ignore collisions and can't roll
+func SimulateMovement(state MovementState, input PlayerInput, speed float64, rollSpeed float64, ghost bool, level *Level) MovementState {
+	if input.Roll && state.RollCooldown == 0 && !ghost {
+		if input.Right {
+			state.RollDuration = math.Pi * -2
+		} else {
+			state.RollDuration = math.Pi * 2
+		}
+		state.RollCooldown = ROLL_COOLDOWN
+	}
+
+	if state.RollDuration > 0 {
+		speed = rollSpeed
+		state.RollDuration = max(0, state.RollDuration-rollSpeed*0.085)
+	} else if state.RollDuration < 0 {
+		speed = rollSpeed
+		state.RollDuration = min(0, state.RollDuration+rollSpeed*0.085)
+	}
+
+	player_pos := &state.Position
+	collides := func() bool {
+		return level != nil && !ghost && level.CheckObjectCollision(*player_pos) != nil
+	}
+
+	if input.Up {
+		player_pos.Y -= speed
+		if collides() {
+			collided_object := level.CheckObjectCollision(*player_pos)
+			player_pos.Y = collided_object.Y + collided_object.Height
+		}
+	}
+
+	if input.Down {
+		player_pos.Y += speed
+		if collides() {
+			collided_object := level.CheckObjectCollision(*player_pos)
+			player_pos.Y = collided_object.Y - TILE_SIZE
+		}
+	}
+
+	if input.Left {
+		player_pos.X -= speed
+		if collides() {
+			collided_object := level.CheckObjectCollision(*player_pos)
+			player_pos.X = collided_object.X + collided_object.Width
+		}
+	}
+
+	if input.Right {
+		player_pos.X += speed
+		if collides() {
+			collided_object := level.CheckObjectCollision(*player_pos)
+			player_pos.X = collided_object.X - TILE_SIZE
+		}
+	}
+
+	state.RollCooldown = max(0, state.RollCooldown-1)
+
+	return state
+}
+
+// RecordInput numbers the input and keeps it until the server has applied it
+func (c *Client) RecordInput(input PlayerInput) PlayerInput {
+	c.next_input++
+	input.Sequence = c.next_input
+
+	c.pending_inputs = append(c.pending_inputs, input)
+	if len(c.pending_inputs) > MAX_PENDING_INPUTS {
+		c.pending_inputs = c.pending_inputs[len(c.pending_inputs)-MAX_PENDING_INPUTS:]
+	}
+	return input
+}
+
+// AckInputs forgets the inputs the server has applied and returns the ones it hasn't yet
+func (c *Client) AckInputs(sequence uint32) []PlayerInput {
+	i := 0
+	for i < len(c.pending_inputs) && c.pending_inputs[i].Sequence <= sequence {
+		i++
+	}
+	c.pending_inputs = c.pending_inputs[i:]
+	return c.pending_inputs
+}
+
+// TakeAuthoritativeState returns where the server last said we are, once per update from the server
+func (c *Client) TakeAuthoritativeState() (ConnectedPlayer, bool) {
+	c.player_states_mutex.Lock()
+	defer c.player_states_mutex.Unlock()
+
+	if !c.has_authoritative_state {
+		return ConnectedPlayer{}, false
+	}
+	c.has_authoritative_state = false
+	return c.authoritative_state, true
+}
+
+// Reconcile starts over from where the server says we are and replays the inputs it hasn't seen yet.
+// Our life is whatever the server says it is
+func (p *Player) Reconcile(authoritative ConnectedPlayer, game *Game) {
+	state := MovementState{authoritative.Position, authoritative.RollDuration, authoritative.RollCooldown}
+
+	speed := p.Speed * game.Modifiers.GetModifiedPlayerValue(ModifierTypeSpeed)
+	for _, input := range game.Client.AckInputs(authoritative.LastInput) {
+		state = SimulateMovement(state, input, speed, p.RollSpeed, p.IsGhost(), game.Level)
+	}
+
+	if state.Position.Distance(p.Position) > RECONCILE_EPSILON {
+		p.Position = state.Position
+	}
+	p.RollDuration = state.RollDuration
+	p.RollCooldown = state.RollCooldown
+	// the server decides who gets hurt, see Server.DamagePlayer
+	p.Life = authoritative.Life
+}
+
+// applyInputs simulates the inputs the server hasn't applied yet, as far as the player's input budget goes
+//
+// Note that calls of this method should happen from Server.handlePacket
+func (s *Server) applyInputs(player *ConnectedPlayer, inputs []PlayerInput) {
+	now := NowMillis()
+	if player.last_input_time == 0 {
+		player.input_budget = MAX_INPUT_BURST
+	} else {
+		player.input_budget += float64(now-player.last_input_time) * INPUT_FRAMES_PER_SECOND / 1000
+		player.input_budget = min(MAX_INPUT_BURST, player.input_budget)
+	}
+	player.last_input_time = now
+
+	speed := PLAYER_SPEED * s.Modifiers.GetModifiedPlayerValue(ModifierTypeSpeed)
+	for _, input := range inputs {
+		if input.Sequence <= player.LastInput {
+			continue
+		}
+		if player.input_budget < 1 {
+			// more inputs than frames, the client will be corrected and send them again if it has to
+			break
+		}
+		player.input_budget--
+
+		state := MovementState{player.Position, player.RollDuration, player.RollCooldown}
+		state = SimulateMovement(state, input, speed, ROLL_SPEED, player.Life < 1, s.level)
+
+		player.Position = state.Position
+		player.RollDuration = state.RollDuration
+		player.RollCooldown = state.RollCooldown
+		player.IsRolling = state.IsRolling()
+		player.LastInput = input.Sequence
+	}
+}
+
+func (s *Server) SpawnPosition() Position {
+	if s.level == nil || s.level.Spawn == nil {
+		return Position{}
+	}
+	return Position{s.level.Spawn.X, s.level.Spawn.Y}
+}
+
+// MovePlayersToSpawn puts everyone at the start of a freshly loaded level, the players do the same on their end
+func (s *Server) MovePlayersToSpawn() {
+	spawn := s.SpawnPosition()
+
+	s.connection_keys_mutex.RLock()
+	for _, conn := range s.connection_keys {
+		s.updatePlayer(conn, func(player *ConnectedPlayer) {
+			player.Position = spawn
+			player.DeadPosition = spawn
+			player.RollDuration = 0
+		})
+	}
+	s.connection_keys_mutex.RUnlock()
+}
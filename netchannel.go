@@ -0,0 +1,443 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	RESEND_INTERVAL_MS  = 100
+	MAX_RESEND_ATTEMPTS = 50
+	// how far ahead of the next expected sequence we are willing to buffer
+	RELIABLE_WINDOW = 256
+
+	// staying below the usual internet MTU so routers don't have to split our datagrams
+	MAX_DATAGRAM_SIZE = 1200
+	// the largest datagram we ever expect to read, anything bigger arrives as fragments
+	READ_BUFFER_SIZE = 2048
+	// FragmentData has an id, index, count and a length prefix on top of the header
+	FRAGMENT_OVERHEAD   = HEADER_SIZE + 4 + 2 + 2 + 4
+	MAX_FRAGMENT_COUNT  = 64
+	FRAGMENT_TIMEOUT_MS = 2000
+)
+
+// returned for reliable packets to a peer that stopped acking, until the game drops it with RemovePeer
+var ErrPeerLost = errors.New("peer stopped acking")
+
+type AckData struct {
+	Sequence uint32
+}
+
+// packets that will be resent until acked and handed over in the order they were sent,
+// everything else is fire and forget
+func IsReliablePacketType(packetType PacketType) bool {
+	switch packetType {
+	case PacketTypeNegotiate,
+		PacketTypeServerStateChanged,
+		PacketTypeModifierChosen,
+		PacketTypeModifiersUpdated,
+		PacketTypePlayerHit,
+		PacketTypeServerEvent,
+		PacketTypeClientToggleReady:
+		return true
+	default:
+		return false
+	}
+}
+
+type FragmentData struct {
+	ID    uint32
+	Index uint16
+	Count uint16
+	Chunk []byte
+}
+
+type fragmentAssembly struct {
+	chunks     [][]byte
+	received   int
+	started_at time.Time
+}
+
+type pendingPacket struct {
+	raw      []byte
+	sent_at  time.Time
+	attempts int
+}
+
+type reliablePeer struct {
+	addr              net.UDPAddr
+	next_sequence     uint32
+	pending           map[uint32]*pendingPacket
+	expected_sequence uint32
+	buffered          map[uint32]PacketData
+}
+
+// NetChannel sits between the game code and the socket and is shared by both the client and the server.
+// Reliable packets get a per peer sequence number, are acked by the receiver and resent until they are,
+// and are only handed to the game in order
+//
+// Packets that don't fit in MAX_DATAGRAM_SIZE are split into PacketTypeFragment datagrams
+// and put back together on the other side before anything else looks at them
+type NetChannel struct {
+	conn        Transport
+	peers       map[string]*reliablePeer
+	peers_mutex sync.Mutex
+	// peers that didn't ack a packet after MAX_RESEND_ATTEMPTS. Sequencing can't go on without
+	// the packet they missed, so nothing reliable goes either way until RemovePeer.
+	// Protected by peers_mutex
+	lost map[string]bool
+
+	next_fragment_id uint32
+	assemblies       map[string]*fragmentAssembly
+	assemblies_mutex sync.Mutex
+
+	closed atomic.Bool
+
+	// stamped on everything we send, see Packet.SessionToken
+	session_token atomic.Uint64
+
+	// peers we can't reach directly and talk to through the mediation server instead, see relay.go
+	relay_server *net.UDPAddr
+	relays       map[string]bool
+	relays_mutex sync.RWMutex
+}
+
+func (nc *NetChannel) SetSessionToken(token uint64) {
+	nc.session_token.Store(token)
+}
+
+func NewNetChannel(conn Transport) *NetChannel {
+	return &NetChannel{
+		conn:       conn,
+		peers:      make(map[string]*reliablePeer),
+		lost:       make(map[string]bool),
+		assemblies: make(map[string]*fragmentAssembly),
+		relays:     make(map[string]bool),
+	}
+}
+
+// writes a serialized packet, splitting it up first if it doesn't fit in a single datagram
+func (nc *NetChannel) writeDatagrams(raw_data []byte, addr *net.UDPAddr) error {
+	if len(raw_data) <= MAX_DATAGRAM_SIZE {
+		return nc.writeDatagram(raw_data, addr)
+	}
+
+	chunkSize := MAX_DATAGRAM_SIZE - FRAGMENT_OVERHEAD
+	count := (len(raw_data) + chunkSize - 1) / chunkSize
+	if count > MAX_FRAGMENT_COUNT {
+		return fmt.Errorf("packet of %d bytes needs %d fragments, the limit is %d", len(raw_data), count, MAX_FRAGMENT_COUNT)
+	}
+
+	id := atomic.AddUint32(&nc.next_fragment_id, 1)
+
+	packet := Packet{}
+	packet.PacketType = PacketTypeFragment
+	packet.SessionToken = nc.session_token.Load()
+	for i := 0; i < count; i++ {
+		chunk := raw_data[i*chunkSize : min(len(raw_data), (i+1)*chunkSize)]
+		fragment, err := SerializePacket(packet, FragmentData{id, uint16(i), uint16(count), chunk})
+		if err != nil {
+			return err
+		}
+
+		err = nc.writeDatagram(fragment, addr)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reassemble collects fragments and returns the original packet once the last one has arrived
+func (nc *NetChannel) reassemble(packet_data PacketData) (PacketData, bool) {
+	var fragment FragmentData
+	err := NewDecoder(packet_data.Data).Decode(&fragment)
+	if err != nil {
+		fmt.Println("error decoding fragment", err)
+		return PacketData{}, false
+	}
+
+	if fragment.Count == 0 || fragment.Count > MAX_FRAGMENT_COUNT || fragment.Index >= fragment.Count {
+		fmt.Println("dropping fragment with invalid index", fragment.Index, "of", fragment.Count)
+		return PacketData{}, false
+	}
+
+	key := fmt.Sprintf("%s/%d", packet_data.Addr.String(), fragment.ID)
+
+	nc.assemblies_mutex.Lock()
+	assembly, ok := nc.assemblies[key]
+	if !ok {
+		assembly = &fragmentAssembly{make([][]byte, fragment.Count), 0, time.Now()}
+		nc.assemblies[key] = assembly
+	}
+
+	if int(fragment.Count) != len(assembly.chunks) {
+		nc.assemblies_mutex.Unlock()
+		return PacketData{}, false
+	}
+
+	if assembly.chunks[fragment.Index] == nil {
+		assembly.chunks[fragment.Index] = fragment.Chunk
+		assembly.received++
+	}
+
+	if assembly.received < len(assembly.chunks) {
+		nc.assemblies_mutex.Unlock()
+		return PacketData{}, false
+	}
+
+	delete(nc.assemblies, key)
+	nc.assemblies_mutex.Unlock()
+
+	raw_data := []byte{}
+	for _, chunk := range assembly.chunks {
+		raw_data = append(raw_data, chunk...)
+	}
+
+	packet, data, err := DeserializePacket(raw_data)
+	if err != nil {
+		fmt.Println("error reading reassembled packet", err)
+		return PacketData{}, false
+	}
+
+	return PacketData{packet, data, packet_data.Addr}, true
+}
+
+func (nc *NetChannel) dropStaleAssemblies() {
+	nc.assemblies_mutex.Lock()
+	for key, assembly := range nc.assemblies {
+		if time.Since(assembly.started_at) > time.Millisecond*FRAGMENT_TIMEOUT_MS {
+			delete(nc.assemblies, key)
+		}
+	}
+	nc.assemblies_mutex.Unlock()
+}
+
+// Note that calls of this method should be protected by locking peers_mutex
+func (nc *NetChannel) getPeer(addr *net.UDPAddr) *reliablePeer {
+	peer, ok := nc.peers[addr.String()]
+	if !ok {
+		peer = &reliablePeer{
+			addr:              *addr,
+			next_sequence:     1,
+			pending:           make(map[uint32]*pendingPacket),
+			expected_sequence: 1,
+			buffered:          make(map[uint32]PacketData),
+		}
+		nc.peers[addr.String()] = peer
+	}
+	return peer
+}
+
+func (nc *NetChannel) Send(packet Packet, data any, addr *net.UDPAddr) error {
+	packet.SessionToken = nc.session_token.Load()
+
+	if !IsReliablePacketType(packet.PacketType) {
+		// forwarded packets can still carry the sequence of whoever sent them to us
+		packet.Sequence = 0
+		raw_data, err := SerializePacket(packet, data)
+		if err != nil {
+			return err
+		}
+		return nc.writeDatagrams(raw_data, addr)
+	}
+
+	nc.peers_mutex.Lock()
+	if nc.lost[addr.String()] {
+		nc.peers_mutex.Unlock()
+		return ErrPeerLost
+	}
+	peer := nc.getPeer(addr)
+	packet.Sequence = peer.next_sequence
+
+	raw_data, err := SerializePacket(packet, data)
+	if err != nil {
+		nc.peers_mutex.Unlock()
+		return err
+	}
+
+	peer.next_sequence++
+	peer.pending[packet.Sequence] = &pendingPacket{raw_data, time.Now(), 1}
+	nc.peers_mutex.Unlock()
+
+	return nc.writeDatagrams(raw_data, addr)
+}
+
+func (nc *NetChannel) sendAck(sequence uint32, addr *net.UDPAddr) {
+	packet := Packet{}
+	packet.PacketType = PacketTypeAck
+	packet.SessionToken = nc.session_token.Load()
+
+	raw_data, err := SerializePacket(packet, AckData{sequence})
+	if err != nil {
+		fmt.Println("error serializing ack", err)
+		return
+	}
+	nc.writeDatagram(raw_data, addr)
+}
+
+// Receive takes a freshly read packet and returns the packets that are ready to be handled,
+// which can be none if it was an ack, a duplicate or arrived out of order
+func (nc *NetChannel) Receive(packet_data PacketData) []PacketData {
+	if packet_data.Packet.PacketType == PacketTypeFragment {
+		reassembled, ok := nc.reassemble(packet_data)
+		if !ok {
+			return nil
+		}
+		packet_data = reassembled
+	}
+
+	if packet_data.Packet.PacketType == PacketTypeAck {
+		var ack AckData
+		err := NewDecoder(packet_data.Data).Decode(&ack)
+		if err != nil {
+			fmt.Println("error decoding ack", err)
+			return nil
+		}
+
+		nc.peers_mutex.Lock()
+		peer, ok := nc.peers[packet_data.Addr.String()]
+		if ok {
+			delete(peer.pending, ack.Sequence)
+		}
+		nc.peers_mutex.Unlock()
+		return nil
+	}
+
+	if packet_data.Packet.Sequence == 0 {
+		return []PacketData{packet_data}
+	}
+
+	sequence := packet_data.Packet.Sequence
+
+	nc.peers_mutex.Lock()
+	if nc.lost[packet_data.Addr.String()] {
+		nc.peers_mutex.Unlock()
+		return nil
+	}
+
+	peer := nc.getPeer(&packet_data.Addr)
+
+	if sequence >= peer.expected_sequence+RELIABLE_WINDOW {
+		// not acking it, the sender will try again once we have caught up
+		nc.peers_mutex.Unlock()
+		return nil
+	}
+
+	ready := []PacketData{}
+	if sequence >= peer.expected_sequence {
+		peer.buffered[sequence] = packet_data
+
+		for {
+			next, ok := peer.buffered[peer.expected_sequence]
+			if !ok {
+				break
+			}
+			delete(peer.buffered, peer.expected_sequence)
+			peer.expected_sequence++
+			ready = append(ready, next)
+		}
+	}
+	nc.peers_mutex.Unlock()
+
+	// acking duplicates as well as the first ack might have been lost
+	nc.sendAck(sequence, &packet_data.Addr)
+
+	return ready
+}
+
+// Resend writes every unacked packet that has been waiting for longer than RESEND_INTERVAL_MS again.
+// Peers that never answer are marked lost, see IsPeerLost
+func (nc *NetChannel) Resend() error {
+	type resend struct {
+		raw  []byte
+		addr net.UDPAddr
+	}
+	resends := []resend{}
+
+	nc.peers_mutex.Lock()
+	now := time.Now()
+	for key, peer := range nc.peers {
+		for sequence, pending := range peer.pending {
+			if now.Sub(pending.sent_at) < time.Millisecond*RESEND_INTERVAL_MS {
+				continue
+			}
+
+			if pending.attempts >= MAX_RESEND_ATTEMPTS {
+				fmt.Printf("%s did not ack packet %d, giving up on it\n", key, sequence)
+				delete(nc.peers, key)
+				nc.lost[key] = true
+				break
+			}
+
+			pending.attempts++
+			pending.sent_at = now
+			resends = append(resends, resend{pending.raw, peer.addr})
+		}
+	}
+	nc.peers_mutex.Unlock()
+
+	for _, r := range resends {
+		err := nc.writeDatagrams(r.raw, &r.addr)
+		if errors.Is(err, net.ErrClosed) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// IsPeerLost is true once addr has stopped acking. The game has to drop the connection
+// and call RemovePeer, a new connection starts over with fresh sequences
+func (nc *NetChannel) IsPeerLost(addr *net.UDPAddr) bool {
+	nc.peers_mutex.Lock()
+	defer nc.peers_mutex.Unlock()
+	return nc.lost[addr.String()]
+}
+
+func (nc *NetChannel) RemovePeer(addr *net.UDPAddr) {
+	nc.peers_mutex.Lock()
+	delete(nc.peers, addr.String())
+	delete(nc.lost, addr.String())
+	nc.peers_mutex.Unlock()
+}
+
+// stops the resend loop, the socket is closed by whoever owns it
+func (nc *NetChannel) Close() {
+	nc.closed.Store(true)
+}
+
+// RebindPeer moves everything we know about a peer over to its new address, so
+// sequence numbers carry on where they left off after its NAT mapping changed
+func (nc *NetChannel) RebindPeer(old_addr *net.UDPAddr, new_addr *net.UDPAddr) {
+	nc.peers_mutex.Lock()
+	peer, ok := nc.peers[old_addr.String()]
+	if ok {
+		delete(nc.peers, old_addr.String())
+		peer.addr = *new_addr
+		nc.peers[new_addr.String()] = peer
+	}
+	if nc.lost[old_addr.String()] {
+		delete(nc.lost, old_addr.String())
+		nc.lost[new_addr.String()] = true
+	}
+	nc.peers_mutex.Unlock()
+}
+
+func (nc *NetChannel) resendLoop() {
+	for !nc.closed.Load() {
+		time.Sleep(time.Millisecond * RESEND_INTERVAL_MS / 2)
+
+		err := nc.Resend()
+		if err != nil {
+			return
+		}
+
+		nc.dropStaleAssemblies()
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingTransport keeps everything written to it, so a test decides what arrives and in which order
+type recordingTransport struct {
+	addr      net.UDPAddr
+	datagrams [][]byte
+	mutex     sync.Mutex
+}
+
+func (rt *recordingTransport) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	return 0, nil, net.ErrClosed
+}
+
+func (rt *recordingTransport) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+	rt.datagrams = append(rt.datagrams, append([]byte{}, b...))
+	return len(b), nil
+}
+
+func (rt *recordingTransport) Close() error {
+	return nil
+}
+
+func (rt *recordingTransport) LocalAddr() net.Addr {
+	addr := rt.addr
+	return &addr
+}
+
+// take hands over everything written since the last call
+func (rt *recordingTransport) take() [][]byte {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+	datagrams := rt.datagrams
+	rt.datagrams = nil
+	return datagrams
+}
+
+// a reliable event that needs several datagrams
+func largeEvent() Event {
+	return Event{SpawnEnemiesEvent, testEnemies(50), []uint{}, LevelOne, []Modifiers{}, testPlayer(1)}
+}
+
+func receiveDatagram(t *testing.T, nc *NetChannel, datagram []byte, from net.UDPAddr) []PacketData {
+	t.Helper()
+	if len(datagram) > MAX_DATAGRAM_SIZE {
+		t.Fatalf("datagram of %d bytes is larger than %d", len(datagram), MAX_DATAGRAM_SIZE)
+	}
+	packet, data, err := DeserializePacket(datagram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nc.Receive(PacketData{packet, data, from})
+}
+
+func checkEvent(t *testing.T, ready []PacketData, want Event) {
+	t.Helper()
+	if len(ready) != 1 {
+		t.Fatalf("got %d packets, want 1", len(ready))
+	}
+	if ready[0].Packet.PacketType != PacketTypeServerEvent {
+		t.Fatalf("got packet type %s", ready[0].Packet.PacketType)
+	}
+
+	got := Event{}
+	err := NewDecoder(ready[0].Data).Decode(&got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("event did not arrive whole, got %d enemies, want %d", len(got.Enemies), len(want.Enemies))
+	}
+}
+
+func TestFragmentedEventOverLoopback(t *testing.T) {
+	sender_conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip("no loopback socket:", err)
+	}
+	defer sender_conn.Close()
+	receiver_conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip("no loopback socket:", err)
+	}
+	defer receiver_conn.Close()
+
+	sender := NewNetChannel(sender_conn)
+	receiver := NewNetChannel(receiver_conn)
+	receiver_addr := *receiver_conn.LocalAddr().(*net.UDPAddr)
+
+	event := largeEvent()
+	raw, _ := SerializePacket(Packet{PacketType: PacketTypeServerEvent}, event)
+	if len(raw) <= MAX_DATAGRAM_SIZE {
+		t.Fatalf("event of %d bytes fits in a single datagram, it has to be fragmented", len(raw))
+	}
+
+	err = sender.Send(Packet{PacketType: PacketTypeServerEvent}, event, &receiver_addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, READ_BUFFER_SIZE)
+	receiver_conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	for {
+		n, addr, err := receiver_conn.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal("event never arrived:", err)
+		}
+		ready := receiveDatagram(t, receiver, buf[:n], *addr)
+		if len(ready) > 0 {
+			checkEvent(t, ready, event)
+			break
+		}
+	}
+
+	// and the sender hears about it
+	sender_conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	n, addr, err := sender_conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal("no ack:", err)
+	}
+	receiveDatagram(t, sender, buf[:n], *addr)
+	sender.peers_mutex.Lock()
+	pending := len(sender.peers[receiver_addr.String()].pending)
+	sender.peers_mutex.Unlock()
+	if pending != 0 {
+		t.Errorf("%d packets still waiting for an ack", pending)
+	}
+}
+
+func TestFragmentsOutOfOrder(t *testing.T) {
+	sender_conn := &recordingTransport{addr: testAddr(1)}
+	receiver_conn := &recordingTransport{addr: testAddr(2)}
+	sender := NewNetChannel(sender_conn)
+	receiver := NewNetChannel(receiver_conn)
+
+	event := largeEvent()
+	err := sender.Send(Packet{PacketType: PacketTypeServerEvent}, event, &receiver_conn.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fragments := sender_conn.take()
+	if len(fragments) < 2 {
+		t.Fatalf("sent as %d datagrams, want fragments", len(fragments))
+	}
+
+	// last one first, and a duplicate on the way
+	for i := len(fragments) - 1; i > 0; i-- {
+		if ready := receiveDatagram(t, receiver, fragments[i], sender_conn.addr); len(ready) != 0 {
+			t.Fatalf("got a packet with fragment 0 still missing")
+		}
+	}
+	receiveDatagram(t, receiver, fragments[len(fragments)-1], sender_conn.addr)
+	checkEvent(t, receiveDatagram(t, receiver, fragments[0], sender_conn.addr), event)
+
+	receiver.assemblies_mutex.Lock()
+	left := len(receiver.assemblies)
+	receiver.assemblies_mutex.Unlock()
+	if left != 0 {
+		t.Errorf("%d assemblies left behind", left)
+	}
+}
+
+func TestLostFragmentIsResent(t *testing.T) {
+	sender_conn := &recordingTransport{addr: testAddr(1)}
+	receiver_conn := &recordingTransport{addr: testAddr(2)}
+	sender := NewNetChannel(sender_conn)
+	receiver := NewNetChannel(receiver_conn)
+
+	event := largeEvent()
+	err := sender.Send(Packet{PacketType: PacketTypeServerEvent}, event, &receiver_conn.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the second fragment never makes it
+	for i, fragment := range sender_conn.take() {
+		if i == 1 {
+			continue
+		}
+		if ready := receiveDatagram(t, receiver, fragment, sender_conn.addr); len(ready) != 0 {
+			t.Fatalf("got a packet with a fragment missing")
+		}
+	}
+	if len(receiver_conn.take()) != 0 {
+		t.Fatalf("acked a packet that never arrived")
+	}
+
+	// the whole packet goes again under a new fragment id
+	time.Sleep(time.Millisecond * (RESEND_INTERVAL_MS + 10))
+	err = sender.Resend()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ready []PacketData
+	for _, fragment := range sender_conn.take() {
+		ready = append(ready, receiveDatagram(t, receiver, fragment, sender_conn.addr)...)
+	}
+	checkEvent(t, ready, event)
+
+	acks := receiver_conn.take()
+	if len(acks) != 1 {
+		t.Fatalf("got %d acks, want 1", len(acks))
+	}
+}
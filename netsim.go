@@ -0,0 +1,262 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// NetConditions is how bad SimulatedTransport makes the network, in each direction
+type NetConditions struct {
+	LatencyMs int
+	// every datagram gets up to this many ms more or less latency, which also reorders them
+	JitterMs int
+	// chances of a datagram getting lost or arriving twice, from 0 to 1
+	Loss        float64
+	Duplication float64
+	// each direction draws from its own source seeded with this, so the same seed drops, duplicates
+	// and delays the same datagrams every run as long as they go through in the same order
+	Seed int64
+}
+
+func (nc NetConditions) Enabled() bool {
+	return nc.LatencyMs > 0 || nc.JitterMs > 0 || nc.Loss > 0 || nc.Duplication > 0
+}
+
+func (nc NetConditions) String() string {
+	return fmt.Sprintf("%dms ±%dms latency, %.0f%% loss, %.0f%% duplication, seed %d",
+		nc.LatencyMs, nc.JitterMs, nc.Loss*100, nc.Duplication*100, nc.Seed)
+}
+
+type delayedDatagram struct {
+	due time.Time
+	// breaks ties so datagrams due at the same time keep their order
+	order uint64
+	data  []byte
+	addr  *net.UDPAddr
+}
+
+type datagramHeap []delayedDatagram
+
+func (h datagramHeap) Len() int { return len(h) }
+func (h datagramHeap) Less(i, j int) bool {
+	if h[i].due.Equal(h[j].due) {
+		return h[i].order < h[j].order
+	}
+	return h[i].due.Before(h[j].due)
+}
+func (h datagramHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *datagramHeap) Push(x any)   { *h = append(*h, x.(delayedDatagram)) }
+func (h *datagramHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// delayQueue hands datagrams to deliver once they are due
+type delayQueue struct {
+	datagrams datagramHeap
+	mutex     sync.Mutex
+	wake      chan struct{}
+}
+
+func newDelayQueue() *delayQueue {
+	return &delayQueue{wake: make(chan struct{}, 1)}
+}
+
+func (q *delayQueue) push(datagram delayedDatagram) {
+	q.mutex.Lock()
+	heap.Push(&q.datagrams, datagram)
+	q.mutex.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers datagrams as they come due until closed is closed
+func (q *delayQueue) run(closed chan struct{}, deliver func(delayedDatagram)) {
+	for {
+		now := time.Now()
+		due := []delayedDatagram{}
+		wait := time.Duration(-1)
+
+		q.mutex.Lock()
+		for len(q.datagrams) > 0 && !q.datagrams[0].due.After(now) {
+			due = append(due, heap.Pop(&q.datagrams).(delayedDatagram))
+		}
+		if len(q.datagrams) > 0 {
+			wait = q.datagrams[0].due.Sub(now)
+		}
+		q.mutex.Unlock()
+
+		for _, datagram := range due {
+			deliver(datagram)
+		}
+
+		if wait < 0 {
+			select {
+			case <-q.wake:
+			case <-closed:
+				return
+			}
+			continue
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-q.wake:
+			timer.Stop()
+		case <-closed:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// simulatedDirection is what SimulatedTransport does to datagrams going one way. Reads and writes
+// happen on different goroutines, sharing a random source would make the draws depend on scheduling
+type simulatedDirection struct {
+	random     *rand.Rand
+	next_order uint64
+	mutex      sync.Mutex
+	queue      *delayQueue
+}
+
+func newSimulatedDirection(seed int64) *simulatedDirection {
+	return &simulatedDirection{random: rand.New(rand.NewSource(seed)), queue: newDelayQueue()}
+}
+
+// SimulatedTransport adds latency, jitter, loss and duplication to everything that goes through it,
+// both what we send and what we receive, so a single end can reproduce a bad connection
+type SimulatedTransport struct {
+	inner      Transport
+	conditions NetConditions
+
+	outgoing *simulatedDirection
+	incoming *simulatedDirection
+	received chan delayedDatagram
+
+	closed     chan struct{}
+	close_once sync.Once
+}
+
+func NewSimulatedTransport(inner Transport, conditions NetConditions) *SimulatedTransport {
+	st := &SimulatedTransport{
+		inner:      inner,
+		conditions: conditions,
+		outgoing:   newSimulatedDirection(conditions.Seed),
+		incoming:   newSimulatedDirection(conditions.Seed + 1),
+		received:   make(chan delayedDatagram),
+		closed:     make(chan struct{}),
+	}
+
+	go st.outgoing.queue.run(st.closed, func(datagram delayedDatagram) {
+		_, err := st.inner.WriteToUDP(datagram.data, datagram.addr)
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			fmt.Println("simulated transport could not send", err)
+		}
+	})
+	go st.incoming.queue.run(st.closed, func(datagram delayedDatagram) {
+		select {
+		case st.received <- datagram:
+		case <-st.closed:
+		}
+	})
+	go st.readLoop()
+
+	return st
+}
+
+// schedule decides what happens to a datagram, which is why it is the only thing using the random sources
+func (st *SimulatedTransport) schedule(direction *simulatedDirection, data []byte, addr *net.UDPAddr) {
+	direction.mutex.Lock()
+	defer direction.mutex.Unlock()
+
+	if direction.random.Float64() < st.conditions.Loss {
+		return
+	}
+
+	copies := 1
+	if direction.random.Float64() < st.conditions.Duplication {
+		copies = 2
+	}
+
+	for i := 0; i < copies; i++ {
+		delay := st.conditions.LatencyMs
+		if st.conditions.JitterMs > 0 {
+			delay += direction.random.Intn(2*st.conditions.JitterMs+1) - st.conditions.JitterMs
+		}
+
+		direction.next_order++
+		direction.queue.push(delayedDatagram{
+			time.Now().Add(time.Duration(max(0, delay)) * time.Millisecond),
+			direction.next_order,
+			data,
+			addr,
+		})
+	}
+}
+
+func (st *SimulatedTransport) readLoop() {
+	buf := make([]byte, READ_BUFFER_SIZE)
+	for {
+		n, addr, err := st.inner.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			fmt.Println("simulated transport could not read", err)
+			continue
+		}
+
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		st.schedule(st.incoming, data, addr)
+	}
+}
+
+func (st *SimulatedTransport) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	select {
+	case datagram := <-st.received:
+		return copy(b, datagram.data), datagram.addr, nil
+	case <-st.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+// WriteToUDP always succeeds straight away, the datagram is sent once its latency has passed
+func (st *SimulatedTransport) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	select {
+	case <-st.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	data := make([]byte, len(b))
+	copy(data, b)
+	// the caller may reuse its address as well
+	to := *addr
+	st.schedule(st.outgoing, data, &to)
+	return len(b), nil
+}
+
+func (st *SimulatedTransport) Close() error {
+	err := net.ErrClosed
+	st.close_once.Do(func() {
+		close(st.closed)
+		err = st.inner.Close()
+	})
+	return err
+}
+
+func (st *SimulatedTransport) LocalAddr() net.Addr {
+	return st.inner.LocalAddr()
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
-	"encoding/gob"
 	"errors"
 	"fmt"
 	"net"
@@ -19,6 +18,12 @@ type Packet struct {
 	Timestamp   uint64
 	PayloadSize uint32
 	TotalSize   uint32
+	Version     uint16
+	// zero for unreliable packets, see NetChannel
+	Sequence uint32
+	// the sender's session token, zero until the host has handed one out.
+	// Lets the host recognise a player whose address changed
+	SessionToken uint64
 }
 
 type PacketData struct {
@@ -29,6 +34,23 @@ type PacketData struct {
 
 const MAGICBYTES = 73458339
 
+// bump this whenever a payload struct or the header layout changes, peers
+// with a different version are rejected during negotiation
+const PROTOCOL_VERSION = 18
+
+// size of the header written by builds before the version field existed
+const LEGACY_HEADER_SIZE = 17 + 8
+
+// size of the header before the session token was added
+const SEQUENCED_HEADER_SIZE = LEGACY_HEADER_SIZE + 2 + 4
+
+const HEADER_SIZE = SEQUENCED_HEADER_SIZE + 8
+
+var ErrVersionMismatch = errors.New("version mismatch")
+var ErrGameInProgress = errors.New("game in progress")
+var ErrRelayDisabled = errors.New("relay disabled")
+var ErrTooManyHosts = errors.New("too many hosts")
+
 type ReconcilliationData struct {
 	Name string
 }
@@ -38,6 +60,7 @@ type Event struct {
 
 	// these fields are considered unions and can be safely considered nil
 	Enemies   []Enemy
+	EnemyIDs  []uint
 	Level     LevelEnum
 	Modifiers []Modifiers
 	Player    ConnectedPlayer
@@ -68,78 +91,216 @@ const (
 	PacketTypeServerEvent
 	PacketTypeClientToggleReady
 	PacketTypeServerStateChanged
-	PacketTypePlayerRoll
 	PacketTypeModifiersUpdated
 	PacketTypeModifierChosen
+	PacketTypeError
+	PacketTypeAck
+	PacketTypeFragment
+	PacketTypePing
+	PacketTypePong
+	PacketTypeLanAnnounce
+	// asks the mediation server for its public lobbies, which it answers with the same type
+	PacketTypeLobbyList
+	// asks the mediation server to relay between us and a host that we could not punch through to
+	PacketTypeRelayStart
+	// a whole datagram passed along by the mediation server, see RelayData
+	PacketTypeRelay
+	// the mediation server's answer to PacketTypeMatchHost with the key we are actually listed under
+	PacketTypeMatchHosted
+	// where the server's enemies are, see EnemySnapshotData
+	PacketTypeUpdateEnemies
+
+	PacketTypeCount
+)
+
+// names used in logs and metrics, in the same order as the types
+var packetTypeNames = [PacketTypeCount - 1]string{
+	"match_find",
+	"match_host",
+	"match_start",
+	"match_connect",
+	"negotiate",
+	"keep_alive",
+	"disconnect",
+	"update_current_player",
+	"update_players",
+	"bullet_start",
+	"player_hit",
+	"server_event",
+	"client_toggle_ready",
+	"server_state_changed",
+	"modifiers_updated",
+	"modifier_chosen",
+	"error",
+	"ack",
+	"fragment",
+	"ping",
+	"pong",
+	"lan_announce",
+	"lobby_list",
+	"relay_start",
+	"relay",
+	"match_hosted",
+	"update_enemies",
+}
+
+func (p PacketType) String() string {
+	if p == 0 || p >= PacketTypeCount {
+		return fmt.Sprintf("unknown_%d", uint8(p))
+	}
+	return packetTypeNames[p-1]
+}
+
+type ErrorCode uint8
+
+const (
+	ErrorCodeVersionMismatch ErrorCode = iota + 1
+	ErrorCodeGameInProgress
+	ErrorCodeRelayDisabled
+	ErrorCodeTooManyHosts
 )
 
+// sent back to a peer when we refuse to talk to it
+type ErrorData struct {
+	Code    ErrorCode
+	Message string
+	Version uint16
+}
+
+func (e ErrorData) Err() error {
+	switch e.Code {
+	case ErrorCodeVersionMismatch:
+		return ErrVersionMismatch
+	case ErrorCodeGameInProgress:
+		return ErrGameInProgress
+	case ErrorCodeRelayDisabled:
+		return ErrRelayDisabled
+	case ErrorCodeTooManyHosts:
+		return ErrTooManyHosts
+	default:
+		return errors.New(e.Message)
+	}
+}
+
+func NewVersionMismatchError(remoteVersion uint16) ErrorData {
+	return ErrorData{
+		ErrorCodeVersionMismatch,
+		fmt.Sprintf("protocol version %d is not compatible with %d", remoteVersion, PROTOCOL_VERSION),
+		PROTOCOL_VERSION,
+	}
+}
+
+func CheckPacketVersion(packet Packet) error {
+	if packet.Version != PROTOCOL_VERSION {
+		return ErrVersionMismatch
+	}
+	return nil
+}
+
+// sent by a client to the host, a session token from an earlier negotiation asks for
+// the player that was left behind when we disconnected
+type NegotiationRequest struct {
+	Name         string
+	SessionToken uint64
+}
+
 type NegotiationResponse struct {
-	Addr net.UDPAddr
+	// the address the host sees us as
+	Addr         net.UDPAddr
+	ID           uint
+	SessionToken uint64
+	// set when the host found our old player, which is followed by a RestorePlayerEvent
+	Reconnected bool
+	// of the run being played or about to start, see ServerState
+	Seed int64
 }
 
+var (
+	ErrPacketTooShort    = errors.New("packet is shorter than its header")
+	ErrInvalidMagicBytes = errors.New("packet has invalid magic bytes")
+	ErrInvalidSizes      = errors.New("packet has invalid sizes")
+	ErrPacketTruncated   = errors.New("packet is truncated")
+	ErrUnknownPacketType = errors.New("packet has unknown type")
+)
+
 func ValidatePacket(packet Packet) error {
-	if packet.TotalSize != packet.HeaderSize+packet.PayloadSize {
-		return errors.New("packet has invalid sizes")
+	if packet.MagicBytes != MAGICBYTES {
+		return ErrInvalidMagicBytes
 	}
 
-	if packet.MagicBytes != MAGICBYTES {
-		return errors.New("packet has invalid magic bytes")
+	if packet.PacketType == 0 || packet.PacketType >= PacketTypeCount {
+		return fmt.Errorf("%w %d", ErrUnknownPacketType, packet.PacketType)
+	}
+
+	if packet.HeaderSize < LEGACY_HEADER_SIZE || packet.HeaderSize == LEGACY_HEADER_SIZE+1 {
+		return fmt.Errorf("%w: header size %d", ErrInvalidSizes, packet.HeaderSize)
+	}
+
+	// checking for overflow as well, these values come straight off the wire
+	if packet.TotalSize != packet.HeaderSize+packet.PayloadSize || packet.TotalSize < packet.HeaderSize {
+		return fmt.Errorf("%w: header %d + payload %d != total %d", ErrInvalidSizes, packet.HeaderSize, packet.PayloadSize, packet.TotalSize)
 	}
 
 	return nil
 }
 
+// DeserializePacket never trusts the sizes in the header, every one of them is checked against the
+// length of the datagram we actually received. Errors can be matched with errors.Is against the Err* values above
 func DeserializePacket(data []byte) (Packet, []byte, error) {
 	var packet Packet
 
-	buf := make([]byte, 2048)
-	_ = copy(buf, data)
+	if len(data) < LEGACY_HEADER_SIZE {
+		return packet, nil, fmt.Errorf("%w: got %d bytes", ErrPacketTooShort, len(data))
+	}
 
-	r := bytes.NewReader(buf)
+	r := bytes.NewReader(data)
 
-	err := binary.Read(r, binary.BigEndian, &packet.PacketType)
-	if err != nil {
-		fmt.Println("error during decoding of packet type", err)
-		return packet, nil, err
-	}
+	// the reader can't run out here as we checked the length against the legacy header above
+	binary.Read(r, binary.BigEndian, &packet.PacketType)
+	binary.Read(r, binary.BigEndian, &packet.HeaderSize)
+	binary.Read(r, binary.BigEndian, &packet.MagicBytes)
+	binary.Read(r, binary.BigEndian, &packet.Timestamp)
+	binary.Read(r, binary.BigEndian, &packet.PayloadSize)
+	binary.Read(r, binary.BigEndian, &packet.TotalSize)
 
-	err = binary.Read(r, binary.BigEndian, &packet.HeaderSize)
+	err := ValidatePacket(packet)
 	if err != nil {
-		fmt.Println("error during decoding of header size", err)
 		return packet, nil, err
 	}
 
-	err = binary.Read(r, binary.BigEndian, &packet.MagicBytes)
-	if err != nil {
-		fmt.Println("error during decoding of magic bytes", err)
-		return packet, nil, err
+	if int64(packet.HeaderSize) > int64(len(data)) {
+		return packet, nil, fmt.Errorf("%w: header of %d bytes in %d bytes", ErrPacketTooShort, packet.HeaderSize, len(data))
 	}
 
-	err = binary.Read(r, binary.BigEndian, &packet.Timestamp)
-	if err != nil {
-		fmt.Println("error during decoding of timestamp", err)
-		return packet, nil, err
+	// older builds don't send a version, and will be treated as version 0
+	if packet.HeaderSize > LEGACY_HEADER_SIZE {
+		err = binary.Read(r, binary.BigEndian, &packet.Version)
+		if err != nil {
+			return packet, nil, fmt.Errorf("%w: %w", ErrPacketTooShort, err)
+		}
 	}
 
-	err = binary.Read(r, binary.BigEndian, &packet.PayloadSize)
-	if err != nil {
-		fmt.Println("error during decoding of paylaod size", err)
-		return packet, nil, err
+	if packet.HeaderSize >= SEQUENCED_HEADER_SIZE {
+		err = binary.Read(r, binary.BigEndian, &packet.Sequence)
+		if err != nil {
+			return packet, nil, fmt.Errorf("%w: %w", ErrPacketTooShort, err)
+		}
 	}
 
-	err = binary.Read(r, binary.BigEndian, &packet.TotalSize)
-	if err != nil {
-		fmt.Println("error during decoding total size", err)
-		return packet, nil, err
+	if packet.HeaderSize >= HEADER_SIZE {
+		err = binary.Read(r, binary.BigEndian, &packet.SessionToken)
+		if err != nil {
+			return packet, nil, fmt.Errorf("%w: %w", ErrPacketTooShort, err)
+		}
 	}
 
-	err = ValidatePacket(packet)
-	if err != nil {
-		fmt.Println("error during packet validation", err)
-		return packet, nil, err
+	// reassembled fragments can be much larger than a single read, so we check against what we actually got
+	if int64(packet.TotalSize) != int64(len(data)) {
+		return packet, nil, fmt.Errorf("%w: expected %d bytes, got %d", ErrPacketTruncated, packet.TotalSize, len(data))
 	}
 
-	rawData := buf[packet.HeaderSize:packet.TotalSize]
+	// copying as the caller reuses its read buffer for the next datagram
+	rawData := append([]byte{}, data[packet.HeaderSize:packet.TotalSize]...)
 	return packet, rawData, nil
 }
 
@@ -147,8 +308,9 @@ func SerializePacket(packet Packet, data interface{}) ([]byte, error) {
 	var buf bytes.Buffer
 
 	// setting metadata
-	packet.HeaderSize = 17 + 8
+	packet.HeaderSize = HEADER_SIZE
 	packet.MagicBytes = MAGICBYTES
+	packet.Version = PROTOCOL_VERSION
 
 	packet.Timestamp = uint64(time.Now().UTC().UnixMilli())
 
@@ -162,11 +324,13 @@ func SerializePacket(packet Packet, data interface{}) ([]byte, error) {
 		return nil, err
 	}
 	packet.PayloadSize = uint32(len(dataBytes))
-	packet.TotalSize = uint32(buf.Len()+8) + uint32(len(dataBytes))
-	// adding the 8 bytes from totalsize and payloadsize values
+	packet.TotalSize = packet.HeaderSize + packet.PayloadSize
 
 	binary.Write(&buf, binary.BigEndian, packet.PayloadSize)
 	binary.Write(&buf, binary.BigEndian, packet.TotalSize)
+	binary.Write(&buf, binary.BigEndian, packet.Version)
+	binary.Write(&buf, binary.BigEndian, packet.Sequence)
+	binary.Write(&buf, binary.BigEndian, packet.SessionToken)
 
 	// Append encoded data
 	buf.Write(dataBytes)
@@ -175,11 +339,10 @@ func SerializePacket(packet Packet, data interface{}) ([]byte, error) {
 }
 
 func serializeData(data interface{}) ([]byte, error) {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(data)
+	w := BinaryWriter{}
+	err := encodePayload(&w, data)
 	if err != nil {
 		return nil, err
 	}
-	return buf.Bytes(), nil
+	return w.Bytes(), nil
 }
@@ -16,14 +16,13 @@ type Player struct {
 	RollSpeed    float64
 	RollDuration float64
 	RollCooldown float64
-	Invulnerable bool
-	GracePeriod  float64
-	Life         int
+	// decided by the server, see Player.Reconcile
+	Life int
 
 	ShootCooldown float64
 }
 
-var GhostSprite *ebiten.Image = GetSpriteByID(121)
+var GhostSprite *ebiten.Image
 
 func (p *Player) Draw(screen *ebiten.Image, camera Camera) {
 	op := ebiten.DrawImageOptions{}
@@ -53,72 +52,32 @@ func (p *Player) IsGhost() bool {
 }
 
 func (p *Player) Update(game *Game) {
-	player_pos := &p.Position
-	initial_pos := *player_pos
+	initial_pos := p.Position
 
-	var speed float64
-	if ebiten.IsKeyPressed(ebiten.KeySpace) && p.RollCooldown == 0 && !p.IsGhost() {
+	input := ReadPlayerInput()
+	if game.Client != nil && game.Client.IsConnected() {
+		// kept until the server has applied it, see Player.Reconcile
+		input = game.Client.RecordInput(input)
+	}
+
+	speed := p.Speed * game.Modifiers.GetModifiedPlayerValue(ModifierTypeSpeed)
+	state := SimulateMovement(MovementState{p.Position, p.RollDuration, p.RollCooldown}, input, speed, p.RollSpeed, p.IsGhost(), game.Level)
+
+	if p.RollCooldown == 0 && state.RollCooldown > 0 {
 		current_pos := initial_pos
 		current_pos.Y += TILE_SIZE
 		direction := math.Pi
-
-		if ebiten.IsKeyPressed(ebiten.KeyD) {
-			p.RollDuration = math.Pi * -2
-		} else {
-			p.RollDuration = math.Pi * 2
+		if !input.Right {
 			current_pos.X += TILE_SIZE
 			direction = 0
 		}
 		game.Sparks = append(game.Sparks, Spark{2, current_pos, direction - .16, 3, 1.5, WHITE})
 		game.Sparks = append(game.Sparks, Spark{2, current_pos, direction + .16, 3, 1.5, WHITE})
-
-		p.Invulnerable = true
-	}
-
-	if p.RollDuration > 0 {
-		speed = p.RollSpeed
-		p.RollDuration = max(0, p.RollDuration-p.RollSpeed*0.085)
-	} else if p.RollDuration < 0 {
-		speed = p.RollSpeed
-		p.RollDuration = min(0, p.RollDuration+p.RollSpeed*0.085)
-	} else {
-		speed = p.Speed
-		speed *= game.Modifiers.GetModifiedPlayerValue(ModifierTypeSpeed)
-		// TODO: should be server decided probs
-		p.Invulnerable = false
-	}
-
-	if ebiten.IsKeyPressed(ebiten.KeyW) {
-		player_pos.Y -= speed
-		collided_object := game.Level.CheckObjectCollision(*player_pos)
-		if collided_object != nil && !p.IsGhost() {
-			player_pos.Y = collided_object.Y + collided_object.Height
-		}
 	}
 
-	if ebiten.IsKeyPressed(ebiten.KeyS) {
-		player_pos.Y += speed
-		collided_object := game.Level.CheckObjectCollision(*player_pos)
-		if collided_object != nil && !p.IsGhost() {
-			player_pos.Y = collided_object.Y - TILE_SIZE
-		}
-	}
-
-	if ebiten.IsKeyPressed(ebiten.KeyA) {
-		player_pos.X -= speed
-		collided_object := game.Level.CheckObjectCollision(*player_pos)
-		if collided_object != nil && !p.IsGhost() {
-			player_pos.X = collided_object.X + collided_object.Width
-		}
-	}
-
-	if ebiten.IsKeyPressed(ebiten.KeyD) {
-		player_pos.X += speed
-		collided_object := game.Level.CheckObjectCollision(*player_pos)
-		if collided_object != nil && !p.IsGhost() {
-			player_pos.X = collided_object.X - TILE_SIZE
-		}
-	}
+	p.Position = state.Position
+	p.RollDuration = state.RollDuration
+	p.RollCooldown = state.RollCooldown
 
 	// "Cooldown" animation when player stops moving
 	if p.Position == initial_pos {
@@ -127,19 +86,6 @@ func (p *Player) Update(game *Game) {
 	} else {
 		p.MoveDuration += 1
 	}
-
-	p.GracePeriod = max(0, p.GracePeriod-.16)
-	if p.GracePeriod == 0 && !p.Invulnerable && !p.IsGhost() {
-		for _, enemy := range game.Enemies {
-			if enemy.Position.X < p.Position.X+TILE_SIZE &&
-				enemy.Position.X+TILE_SIZE > p.Position.X &&
-				enemy.Position.Y < p.Position.Y+TILE_SIZE &&
-				enemy.Position.Y+TILE_SIZE > p.Position.Y {
-				game.Client.SendHit(HitInfo{*game.Client.Self(), GetCharacterDamage(enemy.Type)})
-				p.GracePeriod = DEFAULT_GRACEPERIOD
-			}
-		}
-	}
 }
 
 func (p *Player) GetCenter() Position {
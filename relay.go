@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// how long after the mediation server has matched us we keep trying to punch through before relaying
+	RELAY_FALLBACK_MS = 1500
+	// long enough to give up on punching and still negotiate through the relay
+	CONNECT_TIMEOUT_MS = 5000
+	// how often CheckConnected looks at whether we got through
+	CONNECT_POLL_MS = 10
+	// relayed pairs nobody has sent anything through in this long are forgotten
+	RELAY_SESSION_TIMEOUT_MS = 30000
+)
+
+var ErrUnexpectedRelay = errors.New("relayed packet from someone that isn't our relay")
+
+// a datagram going through the mediation server. On the way there Peer is who it is for,
+// on the way back it is who sent it
+type RelayData struct {
+	Peer     net.UDPAddr
+	Datagram []byte
+}
+
+// SetRelayServer is who we accept relayed packets from, it has to be called before anything is received
+func (nc *NetChannel) SetRelayServer(addr net.UDPAddr) {
+	nc.relay_server = &addr
+}
+
+// RelayThrough sends everything for the peer through the relay server from now on
+func (nc *NetChannel) RelayThrough(peer *net.UDPAddr) {
+	nc.relays_mutex.Lock()
+	nc.relays[peer.String()] = true
+	nc.relays_mutex.Unlock()
+}
+
+func (nc *NetChannel) IsRelayed(peer *net.UDPAddr) bool {
+	nc.relays_mutex.RLock()
+	defer nc.relays_mutex.RUnlock()
+	return nc.relays[peer.String()]
+}
+
+// writes a single datagram, wrapped up for the relay server if we can't reach the peer directly
+func (nc *NetChannel) writeDatagram(raw_data []byte, addr *net.UDPAddr) error {
+	if nc.relay_server == nil || !nc.IsRelayed(addr) {
+		_, err := nc.conn.WriteToUDP(raw_data, addr)
+		return err
+	}
+
+	packet := Packet{}
+	packet.PacketType = PacketTypeRelay
+	packet.SessionToken = nc.session_token.Load()
+
+	wrapped, err := SerializePacket(packet, RelayData{*addr, raw_data})
+	if err != nil {
+		return err
+	}
+
+	_, err = nc.conn.WriteToUDP(wrapped, nc.relay_server)
+	return err
+}
+
+// Unwrap returns the packet a relayed packet carries as if it had come from its sender directly,
+// anything else is returned as it is. Whoever relays to us is relayed to from then on
+func (nc *NetChannel) Unwrap(packet_data PacketData) (PacketData, error) {
+	if packet_data.Packet.PacketType != PacketTypeRelay {
+		return packet_data, nil
+	}
+
+	if nc.relay_server == nil || nc.relay_server.String() != packet_data.Addr.String() {
+		return PacketData{}, ErrUnexpectedRelay
+	}
+
+	var relay RelayData
+	err := NewDecoder(packet_data.Data).Decode(&relay)
+	if err != nil {
+		return PacketData{}, err
+	}
+
+	packet, data, err := DeserializePacket(relay.Datagram)
+	if err != nil {
+		return PacketData{}, err
+	}
+	if packet.PacketType == PacketTypeRelay {
+		return PacketData{}, errors.New("relayed packet inside relayed packet")
+	}
+
+	nc.RelayThrough(&relay.Peer)
+
+	return PacketData{packet, data, relay.Peer}, nil
+}
+
+// fallBackToRelay asks the mediation server to pass our packets along, the host hasn't answered for
+// a while after we were matched. The negotiation being resent then goes through the relay.
+// Note that calls of this method should happen from Client.HandlePacket or Client.Step
+func (c *Client) fallBackToRelay() {
+	c.relay_fallback = nil
+	if c.is_connected.Load() || c.ConnectError() != nil {
+		return
+	}
+
+	fmt.Println("could not reach", c.host_addr.String(), "directly, relaying through the mediation server")
+	c.channel.RelayThrough(&c.host_addr)
+
+	packet := Packet{}
+	packet.PacketType = PacketTypeRelayStart
+
+	// the mediation server doesn't ack, so this is sent a few times instead of reliably
+	for i := 0; i < DISCONNECT_REDUNDANCY; i++ {
+		err := c.channel.Send(packet, ReconcilliationData{c.relay_key}, c.channel.relay_server)
+		if err != nil {
+			fmt.Println("error asking for relay", err)
+			break
+		}
+	}
+}
+
+// RelaySessions are the pairs the mediation server has agreed to pass packets between,
+// anyone else could use it to send packets to hosts from somewhere they don't come from
+type RelaySessions struct {
+	pairs       map[string]int64
+	pairs_mutex sync.Mutex
+}
+
+func NewRelaySessions() *RelaySessions {
+	return &RelaySessions{pairs: make(map[string]int64)}
+}
+
+// the same key no matter which side is sending
+func relayPairKey(a *net.UDPAddr, b *net.UDPAddr) string {
+	if a.String() < b.String() {
+		return a.String() + "|" + b.String()
+	}
+	return b.String() + "|" + a.String()
+}
+
+// Open returns false if there are already MAX_RELAY_SESSIONS other pairs
+func (rs *RelaySessions) Open(a *net.UDPAddr, b *net.UDPAddr) bool {
+	key := relayPairKey(a, b)
+
+	rs.pairs_mutex.Lock()
+	defer rs.pairs_mutex.Unlock()
+
+	if _, ok := rs.pairs[key]; !ok && len(rs.pairs) >= MAX_RELAY_SESSIONS {
+		return false
+	}
+	rs.pairs[key] = time.Now().UnixMilli()
+	return true
+}
+
+// Allow says if a packet may be relayed between the two and keeps the session alive if so
+func (rs *RelaySessions) Allow(a *net.UDPAddr, b *net.UDPAddr) bool {
+	key := relayPairKey(a, b)
+
+	rs.pairs_mutex.Lock()
+	defer rs.pairs_mutex.Unlock()
+
+	if _, ok := rs.pairs[key]; !ok {
+		return false
+	}
+	rs.pairs[key] = time.Now().UnixMilli()
+	return true
+}
+
+// DropStale returns the pairs it has closed
+func (rs *RelaySessions) DropStale() []string {
+	rs.pairs_mutex.Lock()
+	defer rs.pairs_mutex.Unlock()
+
+	closed := []string{}
+	for key, last_used := range rs.pairs {
+		if time.Now().UnixMilli()-last_used > RELAY_SESSION_TIMEOUT_MS {
+			closed = append(closed, key)
+			delete(rs.pairs, key)
+		}
+	}
+	return closed
+}
+
+func (rs *RelaySessions) Count() int {
+	rs.pairs_mutex.Lock()
+	defer rs.pairs_mutex.Unlock()
+	return len(rs.pairs)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+)
+
+// mediationOnly drops everything that isn't for the mediation server, like two NATs that can't be punched through
+type mediationOnly struct {
+	Transport
+	mediation net.UDPAddr
+}
+
+func (mo *mediationOnly) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	if addr.String() != mo.mediation.String() {
+		return len(b), nil
+	}
+	return mo.Transport.WriteToUDP(b, addr)
+}
+
+func waitFor(t *testing.T, what string, timeout time.Duration, done func() bool) {
+	t.Helper()
+	end := time.Now().Add(timeout)
+	for !done() {
+		if time.Now().After(end) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond * CONNECT_POLL_MS)
+	}
+}
+
+// testRelayFallback has a host and a client that only get through to the mediation server on
+// mediation_conn find each other, listen opens their sockets
+func testRelayFallback(t *testing.T, mediation_conn Transport, listen func() (Transport, error)) {
+	mediation_addr := *mediation_conn.LocalAddr().(*net.UDPAddr)
+
+	config := DefaultConfig()
+	config.MediationAddr = mediation_addr.IP.String()
+	config.MediationPort = mediation_addr.Port
+	config.Relay = true
+
+	go ServeMediation(config, mediation_conn, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	defer mediation_conn.Close()
+
+	host_conn, err := listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := Server{}
+	server.UseTransport(&mediationOnly{host_conn, mediation_addr})
+	stop := make(chan struct{})
+	defer close(stop)
+	go server.Host(config, JOIN_KEY_PREFIX+"RLAY", stop)
+	waitFor(t, "the host to be listed", time.Second, server.registered.Load)
+
+	client_conn, err := listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := Client{}
+	client.UseTransport(&mediationOnly{client_conn, mediation_addr})
+	go client.RunClient(config, server.JoinKey())
+	defer client.Close()
+
+	if !client.CheckConnected() {
+		t.Fatalf("never connected, error: %v", client.ConnectError())
+	}
+
+	host_addr := client.HostAddr()
+	if !client.channel.IsRelayed(&host_addr) {
+		t.Errorf("connected to %s without the relay", host_addr.String())
+	}
+	client_addr := *client_conn.LocalAddr().(*net.UDPAddr)
+	if !server.channel.IsRelayed(&client_addr) {
+		t.Errorf("host answers %s without the relay", client_addr.String())
+	}
+
+	waitFor(t, "the host to add the player", time.Second, func() bool {
+		return len(server.GetAlivePlayers()) == 1
+	})
+}
+
+func TestRelayFallback(t *testing.T) {
+	network := NewMemoryNetwork()
+	mediation_conn, err := network.Listen(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testRelayFallback(t, mediation_conn, func() (Transport, error) {
+		return network.Listen(nil)
+	})
+}
+
+func TestRelayFallbackOverLoopback(t *testing.T) {
+	loopback := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	mediation_conn, err := net.ListenUDP("udp", loopback)
+	if err != nil {
+		t.Skip("no loopback socket:", err)
+	}
+
+	testRelayFallback(t, mediation_conn, func() (Transport, error) {
+		return net.ListenUDP("udp", loopback)
+	})
+}
@@ -1,17 +1,37 @@
 package main
 
 import (
-	"bytes"
-	"encoding/gob"
+	crand "crypto/rand"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
 	"math"
 	"math/rand"
 	"net"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// bullets and enemies move a fixed amount every tick, tuned for the same rate ebiten calls Game.Update,
+// see Server.Run
+const SERVER_TICKS_PER_SECOND = 60
+const SERVER_TICK = time.Second / SERVER_TICKS_PER_SECOND
+
+// how many ticks Run catches up on at once after falling behind, anything more is skipped
+const MAX_CATCH_UP_TICKS = 5
+
+// pings and player updates go out every this many ticks
+const PING_INTERVAL_TICKS = PING_INTERVAL_MS * SERVER_TICKS_PER_SECOND / 1000
+const PLAYER_SYNC_INTERVAL_TICKS = SERVER_PLAYER_SYNC_DELAY_MS * SERVER_TICKS_PER_SECOND / 1000
+
+// cooldowns and grace periods were tuned counting down .16 a frame at 60 frames a second,
+// they now count down this much a second however often the server ticks
+const COOLDOWN_UNITS_PER_SECOND = 0.16 * SERVER_TICKS_PER_SECOND
+
 type ConnectedPlayer struct {
 	Addr           net.UDPAddr
 	Position       Position
@@ -23,13 +43,37 @@ type ConnectedPlayer struct {
 	Life           int
 	DeadPosition   Position
 
-	// currently does not work
+	// handed out by the server and never reused, this is what identifies a player
+	// as its address can change under it
 	ID uint
+
+	// round trip time in ms, as measured by the server's pings
+	RTT uint32
+	// how far ahead of the server's clock the player's clock is in ms, only known to the server
+	ClockOffset int64
+	// handed to the player when negotiating so it can reclaim this player after a disconnect,
+	// only known to the server and the player itself
+	SessionToken uint64
+
+	// the last PlayerInput the server has applied, the player replays everything after it
+	LastInput    uint32
+	RollDuration float64
+	RollCooldown float64
+	// how many inputs the player may still send, only known to the server, see applyInputs
+	input_budget    float64
+	last_input_time int64
+	// i-frames left after being hit, only known to the server, see DamagePlayer
+	grace_period float64
+	// how many shots the player may still fire, only known to the server, see validateBullet
+	shot_budget    float64
+	last_shot_time int64
 }
 
 type HitInfo struct {
-	Player ConnectedPlayer
-	Damage int
+	PlayerID uint
+	Damage   int
+	// what the player has left after the hit
+	Life int
 }
 type ServerStateType uint
 
@@ -51,6 +95,10 @@ const (
 	PrepareNewLevelEvent
 	PlayerDiedEvent
 	GameOverEvent
+	// sent to a player that reconnected, carrying the level and the player it left behind
+	RestorePlayerEvent
+	// the enemies that the server has seen die
+	EnemyDiedEvent
 )
 
 type ServerStateContext struct {
@@ -63,43 +111,148 @@ type ServerStateContext struct {
 type ServerState struct {
 	State   ServerStateType
 	Context ServerStateContext
+	// seed of the run being played, or of the next one while in the waiting room
+	Seed int64
 }
 
 type Server struct {
 	mediation_server      net.UDPAddr
-	conn                  *net.UDPConn
-	connection_keys       []string
+	conn                  Transport
+	channel               *NetChannel
+	connection_keys       []uint
 	connection_keys_mutex sync.RWMutex
 	connections           sync.Map
-	packet_channel        chan PacketData
-	started               bool
-	bullets               []Bullet
-	bullets_mutex         sync.RWMutex
-	level                 *Level
-	levelCount            int
-	State                 ServerState
-	Enemies               []Enemy
-	SpawnCooldown         float64
-	Modifiers             Modifiers
-	RemainingSpawnCycles  int
-	JoinKey               string
-}
-
-func (s *Server) GetConnectionByAddr(addr string) *ConnectedPlayer {
+	// held while changing a player in connections, see updatePlayer
+	players_mutex sync.Mutex
+	// maps addresses to player ids, protected by connection_keys_mutex
+	player_ids     map[string]uint
+	next_player_id uint
+	packet_channel chan PacketData
+	started        bool
+	bullets        []Bullet
+	bullets_mutex  sync.RWMutex
+	level          *Level
+	levelCount     int
+	State          ServerState
+	Enemies        []Enemy
+	next_enemy_id  uint
+	// how many times Update has run, enemy snapshots go out every few ticks
+	ticks uint64
+	// what every player has been sent of the others, see BroadcastPlayers
+	player_snapshots       map[uint]*PlayerSnapshotHistory
+	player_snapshots_mutex sync.Mutex
+	snapshot_sequence      uint32
+	// players further apart than this don't get each other's movement, 0 turns it off
+	interest_radius float64
+	// how far in the past players see enemies, see EstimateViewTime
+	interpolation_delay  int64
+	SpawnCooldown        float64
+	Modifiers            Modifiers
+	RemainingSpawnCycles int
+	host_name            string
+
+	// every random choice of a run is made with it, so the same seed and inputs play the same run.
+	// Only used from Update
+	random *rand.Rand
+	// from the -seed flag, every run uses it instead of a new one when set
+	fixed_seed int64
+
+	// may be changed by the mediation server if someone else already has it
+	join_key       string
+	join_key_mutex sync.RWMutex
+	// the mediation server has answered our PacketTypeMatchHost
+	registered atomic.Bool
+	// the mediation server won't list us, direct and LAN joins still work
+	listing_refused atomic.Bool
+
+	// the level s.level was last loaded with, the state context doesn't always carry it.
+	// Read by the lobby announcements as well, see LevelType
+	level_type atomic.Uint64
+
+	// only touched from handlePacket
+	clocks map[uint]*ClockSync
+
+	// players that disconnected or timed out, keyed by their session token, so they can rejoin
+	disconnected sync.Map
+
+	// set by UseTransport
+	injected_transport bool
+
+	// set once Host has opened the socket, Update does nothing before that
+	ready atomic.Bool
+	// closed by Close, stops everything Start started
+	done       chan struct{}
+	close_once sync.Once
+}
+
+func (s *Server) GetConnectionByID(id uint) *ConnectedPlayer {
 	s.connection_keys_mutex.RLock()
 	for _, conn := range s.connection_keys {
+		if conn != id {
+			continue
+		}
 		player, ok := loadFromSyncMap[ConnectedPlayer](conn, &s.connections)
 		if ok {
-			if player.Addr.String() == addr {
-				s.connection_keys_mutex.RUnlock()
-				return &player
-			}
+			s.connection_keys_mutex.RUnlock()
+			return &player
 		}
 	}
 	s.connection_keys_mutex.RUnlock()
 	return nil
 }
 
+func (s *Server) PlayerIDByToken(token uint64) (uint, bool) {
+	s.connection_keys_mutex.RLock()
+	defer s.connection_keys_mutex.RUnlock()
+
+	for _, conn := range s.connection_keys {
+		player, ok := loadFromSyncMap[ConnectedPlayer](conn, &s.connections)
+		if ok && player.SessionToken == token {
+			return conn, true
+		}
+	}
+	return 0, false
+}
+
+func (s *Server) PlayerIDByAddr(addr net.UDPAddr) (uint, bool) {
+	s.connection_keys_mutex.RLock()
+	id, ok := s.player_ids[addr.String()]
+	s.connection_keys_mutex.RUnlock()
+	return id, ok
+}
+
+// rebindPlayer follows a player to a new address when its NAT mapping changes.
+// The session token in the header is what tells us it is still the same player
+func (s *Server) rebindPlayer(packet Packet, addr net.UDPAddr) {
+	if packet.SessionToken == 0 {
+		return
+	}
+
+	s.connection_keys_mutex.Lock()
+	defer s.connection_keys_mutex.Unlock()
+
+	if _, ok := s.player_ids[addr.String()]; ok {
+		return
+	}
+
+	for _, conn := range s.connection_keys {
+		player, ok := loadFromSyncMap[ConnectedPlayer](conn, &s.connections)
+		if !ok || player.SessionToken != packet.SessionToken {
+			continue
+		}
+
+		fmt.Printf("player %d moved from %s to %s\n", player.ID, player.Addr.String(), addr.String())
+		s.channel.RebindPeer(&player.Addr, &addr)
+		delete(s.player_ids, player.Addr.String())
+		s.player_ids[addr.String()] = player.ID
+
+		s.updatePlayer(conn, func(player *ConnectedPlayer) {
+			player.Addr = addr
+		})
+		return
+	}
+}
+
 func loadFromSyncMap[T any](key any, syncMap *sync.Map) (value T, ok bool) {
 	anyValue, ok := syncMap.Load(key)
 	if ok {
@@ -111,7 +264,7 @@ func loadFromSyncMap[T any](key any, syncMap *sync.Map) (value T, ok bool) {
 			return value, false
 		}
 	} else {
-		log.Println("server tried to load non-present key from syncMap, key: ",  key)
+		log.Println("server tried to load non-present key from syncMap, key: ", key)
 		return value, false
 	}
 }
@@ -134,50 +287,240 @@ func (s *Server) GetAlivePlayers() []ConnectedPlayer {
 
 func (s *Server) CheckTimedOutPlayers() {
 	s.connection_keys_mutex.RLock()
-	newConnectionKeys := make([]string, 0)
+	timedOutKeys := make([]uint, 0)
 
 	for _, conn := range s.connection_keys {
 		player, ok := loadFromSyncMap[ConnectedPlayer](conn, &s.connections)
-		if ok && int(player.TimeLastPacket)-int(time.Now().UnixMilli())+TIMEOUT_INTERVAL_MS > 0 {
-			newConnectionKeys = append(newConnectionKeys, conn)
+		if !ok || int(player.TimeLastPacket)-int(time.Now().UnixMilli())+TIMEOUT_INTERVAL_MS <= 0 {
+			timedOutKeys = append(timedOutKeys, conn)
+		} else if s.channel.IsPeerLost(&player.Addr) {
+			// it is still sending but missed a reliable packet for good, so it has to rejoin
+			timedOutKeys = append(timedOutKeys, conn)
 		}
 	}
 	s.connection_keys_mutex.RUnlock()
 
+	for _, key := range timedOutKeys {
+		fmt.Println("player", key, "timed out")
+		s.RemovePlayer(key)
+	}
+
+	if len(timedOutKeys) > 0 {
+		s.BroadcastPlayers()
+	}
+}
+
+// RemovePlayer stops sending anything to the player, but keeps what it looked like
+// so it can pick up where it left off if it reconnects with its session token
+func (s *Server) RemovePlayer(id uint) {
 	s.connection_keys_mutex.Lock()
+	newConnectionKeys := make([]uint, 0)
+	for _, conn := range s.connection_keys {
+		if conn != id {
+			newConnectionKeys = append(newConnectionKeys, conn)
+		}
+	}
 	s.connection_keys = newConnectionKeys
+
+	value, ok := s.connections.LoadAndDelete(id)
+	if !ok {
+		s.connection_keys_mutex.Unlock()
+		return
+	}
+
+	player, ok := value.(ConnectedPlayer)
+	if !ok {
+		s.connection_keys_mutex.Unlock()
+		return
+	}
+	delete(s.player_ids, player.Addr.String())
 	s.connection_keys_mutex.Unlock()
+
+	player.IsReady = false
+	if player.SessionToken != 0 {
+		s.disconnected.Store(player.SessionToken, player)
+	}
+
+	s.channel.RemovePeer(&player.Addr)
+
+	// whatever it acked before is gone along with the player, if it comes back it gets everything again
+	s.player_snapshots_mutex.Lock()
+	delete(s.player_snapshots, id)
+	s.player_snapshots_mutex.Unlock()
+}
+
+// sends every player what changed since the last snapshot it acked, which is also how players learn that someone left
+func (s *Server) BroadcastPlayers() {
+	updatePlayerPacket := Packet{}
+	updatePlayerPacket.PacketType = PacketTypeUpdatePlayers
+
+	connected_player_list := []ConnectedPlayer{}
+
+	s.connection_keys_mutex.RLock()
+	for _, key := range s.connection_keys {
+		value, ok := loadFromSyncMap[ConnectedPlayer](key, &s.connections)
+		if ok {
+			connected_player_list = append(connected_player_list, value)
+		}
+	}
+	s.connection_keys_mutex.RUnlock()
+
+	s.player_snapshots_mutex.Lock()
+	defer s.player_snapshots_mutex.Unlock()
+
+	// shared by everyone, so a player that reconnects never sees an older one than it had
+	s.snapshot_sequence++
+	for _, player := range connected_player_list {
+		history, ok := s.player_snapshots[player.ID]
+		if !ok {
+			history = &PlayerSnapshotHistory{}
+			s.player_snapshots[player.ID] = history
+		}
+
+		data := history.Build(s.snapshot_sequence, connected_player_list, player.ID, s.interest_radius)
+		err := s.channel.Send(updatePlayerPacket, data, &player.Addr)
+		if err != nil {
+			fmt.Println("error sending player snapshot", err)
+		}
+	}
+}
+
+// AckPlayerSnapshot lets the next snapshots of the player be deltas against the one it got
+func (s *Server) AckPlayerSnapshot(id uint, sequence uint32) {
+	s.player_snapshots_mutex.Lock()
+	history, ok := s.player_snapshots[id]
+	if ok {
+		history.Ack(sequence)
+	}
+	s.player_snapshots_mutex.Unlock()
+}
+
+// tells every player that the host is going away, there is no one left to ack it so it is sent a few times
+func (s *Server) Shutdown() {
+	packet := Packet{}
+	packet.PacketType = PacketTypeDisconnect
+
+	for i := 0; i < DISCONNECT_REDUNDANCY; i++ {
+		s.Broadcast(packet, nil)
+
+		// takes us off the lobby list straight away instead of when our keepalives stop
+		if s.HasMediationServer() {
+			s.channel.Send(packet, ReconcilliationData{s.JoinKey()}, &s.mediation_server)
+		}
+	}
+}
+
+func NewSessionToken() uint64 {
+	b := make([]byte, 8)
+	_, err := crand.Read(b)
+	if err != nil {
+		// not secret, just needs to be hard to guess by accident
+		return rand.Uint64() | 1
+	}
+	return binary.BigEndian.Uint64(b) | 1
+}
+
+// restorePlayer sends a reconnected player everything it missed, in the order it needs it
+func (s *Server) restorePlayer(player ConnectedPlayer) {
+	packet := Packet{}
+	packet.PacketType = PacketTypeServerStateChanged
+	err := s.channel.Send(packet, s.State, &player.Addr)
+	if err != nil {
+		fmt.Println("error sending state to reconnected player", err)
+	}
+
+	packet.PacketType = PacketTypeModifiersUpdated
+	err = s.channel.Send(packet, s.Modifiers, &player.Addr)
+	if err != nil {
+		fmt.Println("error sending modifiers to reconnected player", err)
+	}
+
+	event := Event{}
+	event.Type = RestorePlayerEvent
+	event.Level = s.LevelType()
+	event.Player = player
+
+	packet.PacketType = PacketTypeServerEvent
+	err = s.channel.Send(packet, event, &player.Addr)
+	if err != nil {
+		fmt.Println("error sending restored player", err)
+	}
+}
+
+// converts a timestamp stamped by a player's clock to the server's clock.
+// Until we have heard back from a ping we can't tell, so we use the time we got it instead
+func (s *Server) ToServerTime(id uint, timestamp uint64) uint64 {
+	clock, ok := s.clocks[id]
+	if !ok || !clock.Synced() {
+		return uint64(NowMillis())
+	}
+	return uint64(int64(timestamp) - clock.Offset())
+}
+
+func (s *Server) SendPings() {
+	s.connection_keys_mutex.RLock()
+	for _, key := range s.connection_keys {
+		player, ok := loadFromSyncMap[ConnectedPlayer](key, &s.connections)
+		if ok {
+			packet := Packet{}
+			packet.PacketType = PacketTypePing
+
+			err := s.channel.Send(packet, PingData{NowMillis(), player.ClockOffset, player.RTT}, &player.Addr)
+			if err != nil {
+				fmt.Println("error sending ping", err)
+			}
+		}
+	}
+	s.connection_keys_mutex.RUnlock()
 }
 
 func (s *Server) listen() {
-	buf := make([]byte, 2048)
+	buf := make([]byte, READ_BUFFER_SIZE)
 	for {
 		n, addr, err := s.conn.ReadFromUDP(buf)
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			fmt.Println("error reading", err)
+			continue
 		}
 
 		packet, data, err := DeserializePacket(buf[:n])
 		if err != nil {
-			fmt.Println("error reading", err)
+			fmt.Println("dropping invalid packet from", addr, err)
+			continue
+		}
+
+		packet_data, err := s.channel.Unwrap(PacketData{packet, data, *addr})
+		if err != nil {
+			fmt.Println("dropping relayed packet from", addr, err)
+			continue
 		}
 
-		packet_data := PacketData{packet, data, *addr}
-		s.packet_channel <- packet_data
+		// has to happen before the channel sees the packet, so it is sequenced as the player's
+		s.rebindPlayer(packet_data.Packet, packet_data.Addr)
+
+		for _, ready := range s.channel.Receive(packet_data) {
+			select {
+			case s.packet_channel <- ready:
+			case <-s.done:
+				return
+			}
+		}
 	}
 }
 
 func (s *Server) Broadcast(packet Packet, data any) {
 	s.connection_keys_mutex.RLock()
 	for _, value := range s.connection_keys {
-		raw_data, err := SerializePacket(packet, data)
-		if err != nil {
-			fmt.Println("error serializing packet in Broadcast", err)
-		}
-
 		player, ok := loadFromSyncMap[ConnectedPlayer](value, &s.connections)
 		if ok {
-			s.conn.WriteToUDP(raw_data, &player.Addr)
+			// reliable packets are sequenced per player so every player gets their own copy
+			err := s.channel.Send(packet, data, &player.Addr)
+			if err != nil {
+				fmt.Println("error sending packet in Broadcast", err)
+			}
 		}
 	}
 	s.connection_keys_mutex.RUnlock()
@@ -185,7 +528,8 @@ func (s *Server) Broadcast(packet Packet, data any) {
 
 func (s *Server) AllReady() bool {
 	s.connection_keys_mutex.RLock()
-	allReady := true
+	// an empty dedicated server shouldn't start a game on its own
+	allReady := len(s.connection_keys) > 0
 	for _, conn := range s.connection_keys {
 		player, ok := loadFromSyncMap[ConnectedPlayer](conn, &s.connections)
 		if ok {
@@ -200,12 +544,29 @@ func (s *Server) AllReady() bool {
 
 }
 
+// newRun picks the seed of the next run and starts over from the first level.
+// Note that calls of this method should only happen before Update runs or from it
+func (s *Server) newRun() {
+	seed := s.fixed_seed
+	if seed == 0 {
+		seed = NewRunSeed()
+	}
+	s.State.Seed = seed
+	s.random = rand.New(rand.NewSource(seed))
+	s.levelCount = 0
+}
+
+// NewRunSeed is never 0, which is what asks for a new seed
+func NewRunSeed() int64 {
+	return max(1, int64(NewSessionToken()>>1))
+}
+
 func (s *Server) getWaveDensity() int {
 	return s.levelCount
 }
 
 func (s *Server) getNextLevel() LevelEnum {
-	n := rand.Intn(int(LevelCount))
+	n := s.random.Intn(int(LevelCount))
 	if n == 0 {
 		return LevelOne
 	}
@@ -215,21 +576,21 @@ func (s *Server) getNextLevel() LevelEnum {
 func (s *Server) makeRandomModifiers() []Modifiers {
 
 	additiveMod := Modifiers{}
-	n := rand.Intn(int(ModifierTypeCount))
-	v := float64(rand.Intn(15) + 5)
+	n := s.random.Intn(int(ModifierTypeCount))
+	v := float64(s.random.Intn(15) + 5)
 	additiveMod.Monster = append(additiveMod.Monster, Modifier{ModifierCalcTypeAddi, ModifierType(n), v / 100})
 
-	n = rand.Intn(int(ModifierTypeCount))
-	v = float64(rand.Intn(15) + 5)
+	n = s.random.Intn(int(ModifierTypeCount))
+	v = float64(s.random.Intn(15) + 5)
 	additiveMod.Player = append(additiveMod.Player, Modifier{ModifierCalcTypeAddi, ModifierType(n), v / 100})
 
 	multiMod := Modifiers{}
-	n = rand.Intn(int(ModifierTypeCount))
-	v = float64(rand.Intn(15) + 5)
+	n = s.random.Intn(int(ModifierTypeCount))
+	v = float64(s.random.Intn(15) + 5)
 	multiMod.Monster = append(multiMod.Monster, Modifier{ModifierCalcTypeMulti, ModifierType(n), v / 100})
 
-	n = rand.Intn(int(ModifierTypeCount))
-	v = float64(rand.Intn(15) + 5)
+	n = s.random.Intn(int(ModifierTypeCount))
+	v = float64(s.random.Intn(15) + 5)
 	multiMod.Player = append(multiMod.Player, Modifier{ModifierCalcTypeMulti, ModifierType(n), v / 100})
 
 	bothModifiers := []Modifiers{additiveMod, multiMod}
@@ -257,22 +618,23 @@ func (s *Server) UpdateState() {
 			s.SpawnCooldown = INITAL_SPAWN_COOLDOWN
 			s.RemainingSpawnCycles = s.getWaveDensity()
 
-			if !s.started {
+			if !s.started && s.HasMediationServer() {
 				packet := Packet{}
 				packet.PacketType = PacketTypeMatchStart
 
-				data := ReconcilliationData{s.JoinKey}
-				raw_data, _ := SerializePacket(packet, data)
-				_, err := s.conn.WriteToUDP(raw_data, &s.mediation_server)
+				data := ReconcilliationData{s.JoinKey()}
+				err := s.channel.Send(packet, data, &s.mediation_server)
 
 				if err != nil {
 					fmt.Println("error disconnecting from mediation server", err)
 				}
-
-				s.started = true
 			}
+			s.started = true
 
-			LoadLevel(s.level, s.State.Context.Level)
+			LoadLevelData(s.level, s.State.Context.Level)
+			s.level_type.Store(uint64(s.State.Context.Level))
+			s.MovePlayersToSpawn()
+			s.RestoreLife()
 		}
 	} else if s.State.State == ServerStatePlaying {
 		if len(s.GetAlivePlayers()) == 0 {
@@ -299,18 +661,20 @@ func (s *Server) UpdateState() {
 			s.State.Context = ServerStateContext{}
 			s.State.Context.Level = LobbyLevel
 
-			LoadLevel(s.level, LobbyLevel)
-			s.connection_keys_mutex.Lock()
+			LoadLevelData(s.level, LobbyLevel)
+			s.level_type.Store(uint64(LobbyLevel))
+			s.MovePlayersToSpawn()
+			s.connection_keys_mutex.RLock()
 			for _, conn := range s.connection_keys {
-				player, ok := loadFromSyncMap[ConnectedPlayer](conn, &s.connections)
-				if ok {
+				s.updatePlayer(conn, func(player *ConnectedPlayer) {
 					player.IsReady = false
-				}
-				s.connections.Store(conn, player)
+				})
 			}
-			s.connection_keys_mutex.Unlock()
+			s.connection_keys_mutex.RUnlock()
 			s.Enemies = []Enemy{}
 			s.Modifiers = Modifiers{}
+			s.RestoreLife()
+			s.newRun()
 
 			packet := Packet{}
 			packet.PacketType = PacketTypeModifiersUpdated
@@ -332,26 +696,26 @@ func (s *Server) CheckState() {
 	}
 }
 func (s *Server) SetSpawnCooldown() float64 {
-	return float64(MINIMUM_SPAWN_COOLDOWN + rand.Intn(MINIMUM_SPAWN_COOLDOWN))
+	return float64(MINIMUM_SPAWN_COOLDOWN + s.random.Intn(MINIMUM_SPAWN_COOLDOWN))
 }
 
 func (s *Server) StartSpawnMonsterEvent() {
 	totalWidth := s.level.Map.Width * TILE_SIZE
 	totalHeight := s.level.Map.Height * TILE_SIZE
 
-	desiredX := rand.Intn(totalWidth)
-	desiredY := rand.Intn(totalHeight)
+	desiredX := s.random.Intn(totalWidth)
+	desiredY := s.random.Intn(totalHeight)
 
 	radius := 120
 	EnemiesToSpawn := []Enemy{}
-	spawnCount := rand.Intn(MAX_SPAWN_COUNT)
+	spawnCount := s.random.Intn(MAX_SPAWN_COUNT)
 	spawnCount += int(s.Modifiers.getTotalModifiedValue())
 	for i := 0; i < spawnCount; i++ {
-		X := rand.Intn(radius*2) - radius
-		Y := rand.Intn(radius*2) - radius
+		X := s.random.Intn(radius*2) - radius
+		Y := s.random.Intn(radius*2) - radius
 
 		aliveConnections := s.GetAlivePlayers()
-		target := aliveConnections[rand.Intn(len(aliveConnections))]
+		target := aliveConnections[s.random.Intn(len(aliveConnections))]
 
 		// clamping inside arena
 		x := float64(max(0, min(s.level.Map.Width*TILE_SIZE-TILE_SIZE, X+desiredX)))
@@ -362,15 +726,18 @@ func (s *Server) StartSpawnMonsterEvent() {
 
 		speed := GetCharacterSpeed(CharacterZombie)
 		speed *= s.Modifiers.GetModifiedMonsterValue(ModifierTypeSpeed)
+		s.next_enemy_id++
 		enemy := Enemy{
+			s.next_enemy_id,
 			CharacterZombie,
 			Position{x, y},
 			0,
 			0,
 			life,
-			target.Addr.String(),
+			target.ID,
 			[]Position{},
 			speed,
+			SnapshotBuffer{},
 		}
 
 		collision := s.level.CheckObjectCollision(enemy.Position)
@@ -396,7 +763,45 @@ func (s *Server) StartSpawnMonsterEvent() {
 	s.SpawnCooldown = s.SetSpawnCooldown()
 }
 
-func (s *Server) Update() {
+// Run ticks the server every SERVER_TICK until stop is closed, on its own so a host that draws
+// slowly doesn't slow the match down for everyone. Ticks it falls behind on are caught up on.
+// Packets are handled in between ticks, so the simulation is only ever touched from here
+func (s *Server) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(SERVER_TICK)
+	defer ticker.Stop()
+
+	last := time.Now()
+	var behind time.Duration
+	for {
+		select {
+		case <-stop:
+			return
+		case packet_data := <-s.packet_channel:
+			s.handlePacket(packet_data)
+		case now := <-ticker.C:
+			behind += now.Sub(last)
+			last = now
+
+			for ticks := 0; behind >= SERVER_TICK && ticks < MAX_CATCH_UP_TICKS; ticks++ {
+				s.Update(SERVER_TICK.Seconds())
+				behind -= SERVER_TICK
+			}
+			// too far behind to catch up without everything jumping, so we don't
+			if behind >= SERVER_TICK {
+				behind = 0
+			}
+		}
+	}
+}
+
+// Update moves the simulation dt seconds ahead. Bullets and enemies move a fixed amount
+// every call, so it should always be called with SERVER_TICK like Run does
+func (s *Server) Update(dt float64) {
+	if !s.ready.Load() {
+		return
+	}
+
+	now := NowMillis()
 	bullets := []Bullet{}
 
 	s.bullets_mutex.RLock()
@@ -409,48 +814,39 @@ func (s *Server) Update() {
 		bullet.Position.Y += y * float64(bullet.Speed)
 
 		collision_object := s.level.CheckObjectCollision(bullet.Position)
-		bullet.GracePeriod = max(0, bullet.GracePeriod-0.16)
+		bullet.GracePeriod = max(0, bullet.GracePeriod-dt*COOLDOWN_UNITS_PER_SECOND)
 
 		should_remove := false
 		damage := GetWeaponDamage(bullet.WeaponType)
 		damage *= s.Modifiers.GetModifiedPlayerValue(ModifierTypeDamage)
 
-		// it's our bullet shooting enemies, pew pew
+		// it's our bullet shooting enemies, pew pew. They are where the shooter saw them
 		if !bullet.HurtsPlayer {
 			for key, enemy := range s.Enemies {
-				if bullet.Position.X < enemy.Position.X+TILE_SIZE &&
-					bullet.Position.X+4 > enemy.Position.X && // 4 is width
-					bullet.Position.Y < enemy.Position.Y+TILE_SIZE &&
-					bullet.Position.Y+4 > enemy.Position.Y { // 4 is height
+				enemy_pos := enemy.PositionAt(now - bullet.rewind)
+				if bullet.Position.X < enemy_pos.X+TILE_SIZE &&
+					bullet.Position.X+4 > enemy_pos.X && // 4 is width
+					bullet.Position.Y < enemy_pos.Y+TILE_SIZE &&
+					bullet.Position.Y+4 > enemy_pos.Y { // 4 is height
 					should_remove = true
 					s.Enemies[key].Life = max(0, enemy.Life-int(damage))
 					break
 				}
 			}
 		} else if bullet.GracePeriod == 0 {
-			s.connections.Range(func(key, value any) bool {
-				player, ok := value.(ConnectedPlayer)
-				if ok {
-					if bullet.Position.X < player.Position.X+TILE_SIZE &&
-						bullet.Position.X+4 > player.Position.X && // 4 is width
-						bullet.Position.Y < player.Position.Y+TILE_SIZE &&
-						bullet.Position.Y+4 > player.Position.Y { // 4 is height
-						if !player.IsRolling {
-							packet := Packet{}
-							packet.PacketType = PacketTypePlayerHit
-
-							damage := GetWeaponDamage(bullet.WeaponType)
-							damage *= s.Modifiers.GetModifiedMonsterValue(ModifierTypeDamage)
-							s.Broadcast(packet, HitInfo{player, int(damage)}) // TODO: fix damage etc.
-						}
-						should_remove = true
-					}
-				} else {
-					log.Println("found something that wasn't a ConnectedPlayer iterating over sync.Map!")
+			// ghosts don't stop bullets, everyone else does even if it doesn't hurt them
+			for _, player := range s.GetAlivePlayers() {
+				if bullet.Position.X < player.Position.X+TILE_SIZE &&
+					bullet.Position.X+4 > player.Position.X && // 4 is width
+					bullet.Position.Y < player.Position.Y+TILE_SIZE &&
+					bullet.Position.Y+4 > player.Position.Y { // 4 is height
+					damage := GetWeaponDamage(bullet.WeaponType)
+					damage *= s.Modifiers.GetModifiedMonsterValue(ModifierTypeDamage)
+					s.DamagePlayer(player.ID, int(damage))
+					should_remove = true
+					break
 				}
-				// Iteration will stop if the function returns false for an element
-				return true
-			})
+			}
 		}
 
 		if collision_object != nil {
@@ -468,11 +864,12 @@ func (s *Server) Update() {
 
 	s.CheckState()
 
-	s.SpawnCooldown = max(0, s.SpawnCooldown-0.16)
+	s.SpawnCooldown = max(0, s.SpawnCooldown-dt*COOLDOWN_UNITS_PER_SECOND)
 
 	enemies := []Enemy{}
+	dead := []Enemy{}
 	for key := range s.Enemies {
-		target := s.GetConnectionByAddr(s.Enemies[key].Target)
+		target := s.GetConnectionByID(s.Enemies[key].Target)
 
 		if target != nil {
 			s.Enemies[key].FindPath(target.Position, s.level.ObstacleMatrix)
@@ -482,244 +879,549 @@ func (s *Server) Update() {
 				s.Enemies[key].FindPath(target.DeadPosition, s.level.ObstacleMatrix)
 			}
 		} else {
+			// whoever it was chasing left, so it goes after someone else
 			log.Println("enemy could not find target player: ", s.Enemies[key].Target)
+			aliveConnections := s.GetAlivePlayers()
+			if len(aliveConnections) > 0 {
+				s.Enemies[key].Target = aliveConnections[s.random.Intn(len(aliveConnections))].ID
+			}
 		}
 
 		s.Enemies[key].Update()
 
 		if s.Enemies[key].Life > 0 {
 			enemies = append(enemies, s.Enemies[key])
+		} else {
+			dead = append(dead, s.Enemies[key])
 		}
 	}
 	s.Enemies = enemies
+	s.RecordEnemyPositions(now)
+
+	s.TickGracePeriods(dt)
+	s.CheckEnemyContact()
+
+	s.BroadcastEnemyDeaths(dead)
+	s.ticks++
+	if s.ticks%ENEMY_SYNC_INTERVAL_TICKS == 0 {
+		s.BroadcastEnemies()
+	}
+	if s.ticks%PLAYER_SYNC_INTERVAL_TICKS == 0 {
+		s.BroadcastPlayers()
+	}
+	if s.ticks%PING_INTERVAL_TICKS == 0 {
+		s.SendPings()
+	}
 
 	s.CheckTimedOutPlayers()
 }
 
 // Note that calls of this method should be protected by write-locking connection_keys_mutex
-func (s *Server) AddConnection(key string, new_connection ConnectedPlayer) {
+func (s *Server) AddConnection(new_connection ConnectedPlayer) {
 	for _, value := range s.connection_keys {
-		if key == value {
+		if new_connection.ID == value {
 			return
 		}
 	}
-	s.connection_keys = append(s.connection_keys, key)
-	s.connections.Store(key, new_connection)
+	s.connection_keys = append(s.connection_keys, new_connection.ID)
+	s.connections.Store(new_connection.ID, new_connection)
+	s.player_ids[new_connection.Addr.String()] = new_connection.ID
+}
+
+// join keys at the mediation server are namespaced, players only ever see the code after the prefix
+const JOIN_KEY_PREFIX = "gmtk2024:"
+
+func NewJoinCode() string {
+	const letters = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+	result := make([]byte, 4)
+	for i := range result {
+		result[i] = letters[rand.Intn(len(letters))]
+	}
+	return string(result)
+}
+
+// LevelType is the level being played, safe to call from any goroutine
+func (s *Server) LevelType() LevelEnum {
+	return LevelEnum(s.level_type.Load())
+}
+
+func (s *Server) HasMediationServer() bool {
+	return s.mediation_server.IP != nil
 }
 
-func (s *Server) Host(mediation_server_ip string, key string) {
-	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("0.0.0.0"), Port: SERVERPORT})
-	s.conn = conn
+func (s *Server) JoinKey() string {
+	s.join_key_mutex.RLock()
+	defer s.join_key_mutex.RUnlock()
+	return s.join_key
+}
+
+func (s *Server) setJoinKey(key string) {
+	s.join_key_mutex.Lock()
+	s.join_key = key
+	s.join_key_mutex.Unlock()
+}
+
+func (s *Server) JoinCode() string {
+	return strings.TrimPrefix(s.JoinKey(), JOIN_KEY_PREFIX)
+}
+
+func (s *Server) fromMediationServer(addr net.UDPAddr) bool {
+	return s.HasMediationServer() && addr.String() == s.mediation_server.String()
+}
+
+// UseTransport makes the server listen on transport instead of opening a socket, which is
+// how it runs on a MemoryNetwork. Whoever hands it over decides how the server is found,
+// so it doesn't announce itself on the LAN
+func (s *Server) UseTransport(transport Transport) {
+	s.conn = transport
+	s.injected_transport = true
+}
+
+// Host opens the server and runs it until stop is closed, see Run
+func (s *Server) Host(config Config, key string, stop <-chan struct{}) {
+	err := s.Start(config, key)
 	if err != nil {
 		fmt.Println("Error dialing UDP:", err)
 		return
 	}
-	defer conn.Close()
+	defer s.Close()
+
+	s.Run(stop)
+}
+
+// Start opens the server and starts everything that runs on its own, packets and ticks are left
+// for Run, or Step and Update, to handle. An empty mediation address keeps us off the lobby list
+func (s *Server) Start(config Config, key string) error {
+	var mediation_addr *net.UDPAddr
+	if config.MediationAddr != "" {
+		var err error
+		mediation_addr, err = config.ResolveMediationAddr()
+		if err != nil {
+			// we can still be joined directly or over the LAN without it
+			fmt.Println("Error resolving mediation server, only direct joins will work:", err)
+		}
+	}
+
+	if s.conn == nil {
+		conn, err := ListenTransport(config, config.ServerListenAddr())
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	conn := s.conn
 
-	s.JoinKey = key
+	s.setJoinKey(key)
+	s.host_name = config.HostName
 	data := ReconcilliationData{key}
 
 	packet := Packet{}
 	packet.PacketType = PacketTypeMatchHost
 
-	s.mediation_server = net.UDPAddr{IP: net.ParseIP(mediation_server_ip), Port: MEDIATION_SERVERPORT}
+	s.channel = NewNetChannel(conn)
+	if mediation_addr != nil {
+		s.mediation_server = *mediation_addr
+		// players we can't punch through to reach us through it instead
+		s.channel.SetRelayServer(*mediation_addr)
 
-	raw_data, _ := SerializePacket(packet, data)
-	_, err = conn.WriteToUDP(raw_data, &s.mediation_server)
-	if err != nil {
-		fmt.Println("Error sending data:", err)
-		return
+		err := s.channel.Send(packet, data, &s.mediation_server)
+		if err != nil {
+			fmt.Println("Error sending data:", err)
+		}
 	}
 
 	s.packet_channel = make(chan PacketData)
+	s.done = make(chan struct{})
 
 	s.connections = sync.Map{}
+	s.player_ids = make(map[string]uint)
+	s.next_player_id = 1
+	s.clocks = make(map[uint]*ClockSync)
+	s.player_snapshots = make(map[uint]*PlayerSnapshotHistory)
+	s.interest_radius = float64(config.InterestRadius)
+	s.interpolation_delay = int64(config.InterpolationDelayMs)
+
+	s.fixed_seed = int64(config.Seed)
+	s.newRun()
+	fmt.Println("first run has seed", s.State.Seed)
 
 	s.State.State = ServerStateWaitingRoom
+	s.level = &Level{}
+	LoadLevelData(s.level, LobbyLevel)
+	s.level_type.Store(uint64(LobbyLevel))
 
 	go s.listen()
+	go s.channel.resendLoop()
+	s.ready.Store(true)
+
+	if !s.injected_transport {
+		go s.AnnounceLAN(config.LanPort)
+	}
 
 	go func() {
-		for {
-			time.Sleep(time.Second * 2)
+		for s.HasMediationServer() && !s.listing_refused.Load() {
+			select {
+			case <-s.done:
+				return
+			case <-time.After(time.Second * 2):
+			}
+
+			// the first PacketTypeMatchHost or its answer might have been lost
+			if !s.registered.Load() {
+				hostPacket := Packet{}
+				hostPacket.PacketType = PacketTypeMatchHost
+				error := s.channel.Send(hostPacket, ReconcilliationData{s.JoinKey()}, &s.mediation_server)
+				if error != nil {
+					fmt.Println("something went wrong when registering at the mediation server", error)
+				}
+				continue
+			}
 
 			keepAlivePacket := Packet{}
 			keepAlivePacket.PacketType = PacketTypeKeepAlive
-			serialized_packet, _ := SerializePacket(keepAlivePacket, ReconcilliationData{"keepalive"})
-
-			_, error := conn.WriteToUDP(serialized_packet, &s.mediation_server)
+			// the keepalive doubles as our entry in the public lobby list
+			error := s.channel.Send(keepAlivePacket, s.HostMetadata(), &s.mediation_server)
 			if error != nil {
 				fmt.Println("something went wrong when reaching out to match", error)
 			}
-			if s.started {
-				return
-			}
 		}
 	}()
 
-	go func() {
-		for {
-			time.Sleep(time.Millisecond * SERVER_PLAYER_SYNC_DELAY_MS)
+	return nil
+}
 
-			updatePlayerPacket := Packet{}
-			updatePlayerPacket.PacketType = PacketTypeUpdatePlayers
+// Close stops everything Start started and closes the socket
+func (s *Server) Close() {
+	s.close_once.Do(func() {
+		close(s.done)
+		s.channel.Close()
+		s.conn.Close()
+	})
+}
 
-			connected_player_list := []ConnectedPlayer{}
+// Step handles the packets that have arrived without waiting for more, for driving the server by hand.
+// It returns how many it handled
+func (s *Server) Step() int {
+	handled := 0
+	for {
+		select {
+		case packet_data := <-s.packet_channel:
+			s.handlePacket(packet_data)
+			handled++
+		default:
+			return handled
+		}
+	}
+}
 
-			s.connection_keys_mutex.RLock()
-			for _, key := range s.connection_keys {
-				value, ok := loadFromSyncMap[ConnectedPlayer](key, &s.connections)
-				if ok {
-					connected_player_list = append(connected_player_list, value)
-				}
-			}
-			s.connection_keys_mutex.RUnlock()
+func (s *Server) handlePacket(packet_data PacketData) {
+	dec := NewDecoder(packet_data.Data)
+	switch packet_data.Packet.PacketType {
+	case PacketTypeMatchConnect:
+		var new_connection net.UDPAddr
+		err := dec.Decode(&new_connection)
+		if err != nil {
+			fmt.Println("error decoding match address", err)
+			return
+		}
+
+		// the player is only added once its negotiation gets through, all we do here is
+		// open up our NAT towards it so that it can
+		punchPacket := Packet{}
+		punchPacket.PacketType = PacketTypeKeepAlive
 
-			s.Broadcast(updatePlayerPacket, connected_player_list)
+		error := s.channel.Send(punchPacket, nil, &new_connection)
+		if error != nil {
+			fmt.Println("something went wrong when reaching out to match", error)
 		}
-	}()
 
-	for {
-		select {
-		case packet_data := <-s.packet_channel:
-			dec := gob.NewDecoder(bytes.NewReader(packet_data.Data))
-			switch packet_data.Packet.PacketType {
-			case PacketTypeMatchConnect:
-				var new_connection net.UDPAddr
-				dec.Decode(&new_connection)
-
-				s.connection_keys_mutex.Lock()
-				// sync.Map (which is a struct) doesn't have an equivalent method to len()
-				new_player := ConnectedPlayer{
-					new_connection,
-					Position{},
-					0,
-					0,
-					false,
-					false,
-					packet_data.Packet.Timestamp,
-					PLAYER_LIFE,
-					Position{},
-					uint(len(s.connection_keys)) + 1,
-				}
-				s.AddConnection(new_connection.String(), new_player)
-				s.connection_keys_mutex.Unlock()
+		fmt.Println("got new connection from", new_connection.String())
 
-				negotiatePacket := Packet{}
-				negotiatePacket.PacketType = PacketTypeNegotiate
-				data := new_player.ID
+	case PacketTypeMatchHosted:
+		if !s.fromMediationServer(packet_data.Addr) {
+			return
+		}
 
-				raw_data, error := SerializePacket(negotiatePacket, data)
-				if error != nil {
-					fmt.Println("error serializing packet", error)
-				}
+		var hosted ReconcilliationData
+		err := dec.Decode(&hosted)
+		if err != nil {
+			fmt.Println("error decoding hosted key", err)
+			return
+		}
 
-				_, error = conn.WriteToUDP(raw_data, &new_connection)
-				if error != nil {
-					fmt.Println("something went wrong when reaching out to match", error)
-				}
+		if hosted.Name != s.JoinKey() {
+			fmt.Printf("%s was taken, we are listed as %s\n", s.JoinCode(), strings.TrimPrefix(hosted.Name, JOIN_KEY_PREFIX))
+			s.setJoinKey(hosted.Name)
+		}
+		s.registered.Store(true)
 
-				fmt.Println("got new connection with id ", data)
-				fmt.Println("connections: ", &s.connections)
+	case PacketTypeError:
+		if !s.fromMediationServer(packet_data.Addr) {
+			return
+		}
 
-			case PacketTypeNegotiate:
-				var inner_data ReconcilliationData
-				dec.Decode(&inner_data)
+		var errorData ErrorData
+		err := dec.Decode(&errorData)
+		if err != nil {
+			fmt.Println("error decoding error", err)
+			return
+		}
 
-				// if we get this packet there is a presumption that we have already
-				// broken through the NAT address by sending a packet to said address.
+		fmt.Println("mediation server refused to list us:", errorData.Message)
+		if errors.Is(errorData.Err(), ErrTooManyHosts) {
+			s.listing_refused.Store(true)
+		}
 
-				// therefore we can safely assume that the incomming packet is from the owner we want to connect with
-				// and then we can set the owner of the packet to our desired target address to assert the case
-				s.connection_keys_mutex.Lock()
-				for _, key := range s.connection_keys {
-					if packet_data.Addr.String() == key {
-						break
-					}
-				}
-				s.AddConnection(packet_data.Addr.String(), ConnectedPlayer{
-					packet_data.Addr,
-					Position{},
-					0,
-					0,
-					false,
-					false,
-					packet_data.Packet.Timestamp,
-					PLAYER_LIFE,
-					Position{},
-					uint(len(s.connection_keys)) + 1},
-				)
-				s.connection_keys_mutex.Unlock()
-
-			case PacketTypeUpdateCurrentPlayer:
-				var playerUpdate PlayerUpdateData
-				decode_err := dec.Decode(&playerUpdate)
-				if decode_err != nil {
-					fmt.Println("error decoding player update: ", decode_err)
-					continue
-				}
+	case PacketTypeNegotiate:
+		var request NegotiationRequest
+		// older clients send a different payload, so they have to be told before we try to decode it
+		if err := CheckPacketVersion(packet_data.Packet); err != nil {
+			fmt.Printf("rejecting %s, client has protocol version %d\n", packet_data.Addr.String(), packet_data.Packet.Version)
 
-				player, ok := loadFromSyncMap[ConnectedPlayer](packet_data.Addr.String(), &s.connections)
-				DeadPosition := player.DeadPosition
-				if player.Life > 0 {
-					DeadPosition = playerUpdate.Position
-				}
-				if ok {
-					player.Position = playerUpdate.Position
-					player.Rotation = playerUpdate.Rotation
-					player.Weapon = playerUpdate.Weapon
-					player.IsRolling = playerUpdate.isRolling
-					player.TimeLastPacket = packet_data.Packet.Timestamp
-					player.Life = playerUpdate.Life
-					player.DeadPosition = DeadPosition
-
-					s.connections.Store(packet_data.Addr.String(), player)
-				}
+			errorPacket := Packet{}
+			errorPacket.PacketType = PacketTypeError
+			s.channel.Send(errorPacket, NewVersionMismatchError(packet_data.Packet.Version), &packet_data.Addr)
+			return
+		}
 
-			case PacketTypeClientToggleReady:
-				if s.started && (s.State.State != ServerStateWaitingRoom || s.State.State != ServerStateStarting) {
-					continue
-				}
-				player, ok := loadFromSyncMap[ConnectedPlayer](packet_data.Addr.String(), &s.connections)
-				if ok {
-					player.IsReady = !player.IsReady
-				}
-				s.connections.Store(packet_data.Addr.String(), player)
+		err := dec.Decode(&request)
+		if err != nil {
+			fmt.Println("error decoding negotiation", err)
+			return
+		}
 
-			case PacketTypePlayerHit:
-				var hitInfo HitInfo
-				dec.Decode(&hitInfo)
-				s.Broadcast(packet_data.Packet, hitInfo)
+		// if we get this packet there is a presumption that we have already
+		// broken through the NAT address by sending a packet to said address.
 
-			case PacketTypeModifierChosen:
-				var modifiers Modifiers
-				dec.Decode(&modifiers)
+		// therefore we can safely assume that the incomming packet is from the owner we want to connect with
+		// and then we can set the owner of the packet to our desired target address to assert the case
+		key := packet_data.Addr.String()
+		reconnected := false
 
-				s.State.Context.HasChosenOptions = true
+		// a player coming back before it timed out still has its old self lying around
+		_, known := s.PlayerIDByAddr(packet_data.Addr)
+		if !known && request.SessionToken != 0 {
+			old_id, found := s.PlayerIDByToken(request.SessionToken)
+			if found {
+				s.RemovePlayer(old_id)
+			}
+		}
 
-				s.Modifiers.Add(modifiers)
-				packet := Packet{}
-				packet.PacketType = PacketTypeModifiersUpdated
+		s.connection_keys_mutex.Lock()
+		var player ConnectedPlayer
+		id, ok := s.player_ids[key]
+		if ok {
+			player, ok = loadFromSyncMap[ConnectedPlayer](id, &s.connections)
+		}
+		if !ok && request.SessionToken != 0 {
+			value, found := s.disconnected.LoadAndDelete(request.SessionToken)
+			if found {
+				player = value.(ConnectedPlayer)
+				player.Addr = packet_data.Addr
+				player.TimeLastPacket = uint64(NowMillis())
+				player.RTT = 0
+				player.ClockOffset = 0
+				s.AddConnection(player)
+				ok = true
+				reconnected = true
+			}
+		}
+		// new players can only join in the lobby, everyone else has to be someone coming back
+		if !ok && s.LevelType() != LobbyLevel {
+			s.connection_keys_mutex.Unlock()
+			fmt.Printf("rejecting %s, the game has already started\n", key)
+
+			errorPacket := Packet{}
+			errorPacket.PacketType = PacketTypeError
+			s.channel.Send(errorPacket, ErrorData{ErrorCodeGameInProgress, "the game has already started", PROTOCOL_VERSION}, &packet_data.Addr)
+			return
+		}
+		if !ok {
+			player = ConnectedPlayer{
+				packet_data.Addr,
+				s.SpawnPosition(),
+				0,
+				0,
+				false,
+				false,
+				uint64(NowMillis()),
+				PLAYER_LIFE,
+				Position{},
+				s.next_player_id,
+				0,
+				0,
+				NewSessionToken(),
+				0,
+				0,
+				0,
+				0,
+				0,
+				0,
+				0,
+				0,
+			}
+			s.next_player_id++
+			s.AddConnection(player)
+		}
+		s.connection_keys_mutex.Unlock()
 
-				s.Broadcast(packet, s.Modifiers)
+		// the player's clock might have changed along with its address
+		if reconnected {
+			delete(s.clocks, player.ID)
+		}
+
+		// answering so the client knows it got through and which id it has
+		negotiatePacket := Packet{}
+		negotiatePacket.PacketType = PacketTypeNegotiate
 
-			case PacketTypeBulletStart:
-				var bullet Bullet
-				dec.Decode(&bullet)
-				s.Broadcast(packet_data.Packet, bullet)
+		err = s.channel.Send(negotiatePacket, NegotiationResponse{packet_data.Addr, player.ID, player.SessionToken, reconnected, s.State.Seed}, &packet_data.Addr)
+		if err != nil {
+			fmt.Println("error sending packet", err)
+		}
 
-				bullet.GracePeriod = 1.5
-				s.bullets_mutex.Lock()
-				s.bullets = append(s.bullets, bullet)
-				s.bullets_mutex.Unlock()
+		if reconnected {
+			fmt.Println(key, "reconnected as player", player.ID)
+			s.restorePlayer(player)
+		}
 
-			case PacketTypePlayerRoll:
-				player, ok := loadFromSyncMap[ConnectedPlayer](packet_data.Addr.String(), &s.connections)
-				if ok {
-					player.IsRolling = true
-				}
-				s.connections.Store(packet_data.Addr.String(), player)
+	case PacketTypeDisconnect:
+		id, ok := s.PlayerIDByAddr(packet_data.Addr)
+		if !ok {
+			return
+		}
+
+		fmt.Println("player", id, "disconnected")
+		s.RemovePlayer(id)
+		delete(s.clocks, id)
+		s.BroadcastPlayers()
+
+	case PacketTypeUpdateCurrentPlayer:
+		var playerUpdate PlayerUpdateData
+		decode_err := dec.Decode(&playerUpdate)
+		if decode_err != nil {
+			fmt.Println("error decoding player update: ", decode_err)
+			return
+		}
+
+		id, ok := s.PlayerIDByAddr(packet_data.Addr)
+		if !ok {
+			return
+		}
+
+		s.AckPlayerSnapshot(id, playerUpdate.SnapshotAck)
+		s.updatePlayer(id, func(player *ConnectedPlayer) {
+			// the player only tells us what it pressed, where that gets it is up to us
+			s.applyInputs(player, playerUpdate.Inputs)
+
+			// and how much life it has is up to us as well, see DamagePlayer
+			if player.Life > 0 {
+				player.DeadPosition = player.Position
 			}
+
+			player.Rotation = playerUpdate.Rotation
+			player.Weapon = playerUpdate.Weapon
+			player.TimeLastPacket = s.ToServerTime(id, packet_data.Packet.Timestamp)
+		})
+
+	case PacketTypePong:
+		var pong PongData
+		err := dec.Decode(&pong)
+		if err != nil {
+			fmt.Println("error decoding pong", err)
+			return
+		}
+
+		id, ok := s.PlayerIDByAddr(packet_data.Addr)
+		if !ok {
+			return
+		}
+
+		clock, ok := s.clocks[id]
+		if !ok {
+			clock = &ClockSync{}
+			s.clocks[id] = clock
+		}
+
+		now := NowMillis()
+		clock.AddSample(pong.ServerSendTime, pong.ClientReceiveTime, pong.ClientSendTime, now)
+
+		s.updatePlayer(id, func(player *ConnectedPlayer) {
+			player.ClockOffset = clock.Offset()
+			player.RTT = uint32(clock.RTT())
+			player.TimeLastPacket = uint64(now)
+		})
+
+	case PacketTypeClientToggleReady:
+		if s.started && (s.State.State != ServerStateWaitingRoom && s.State.State != ServerStateStarting) {
+			return
+		}
+		id, ok := s.PlayerIDByAddr(packet_data.Addr)
+		if !ok {
+			return
+		}
+
+		s.updatePlayer(id, func(player *ConnectedPlayer) {
+			player.IsReady = !player.IsReady
+		})
+
+	case PacketTypeModifierChosen:
+		var modifiers Modifiers
+		err := dec.Decode(&modifiers)
+		if err != nil {
+			fmt.Println("error decoding modifiers", err)
+			return
+		}
+
+		// only one pick per level, and only out of what we offered
+		if s.State.State != ServerStateLevelCompleted || s.State.Context.HasChosenOptions {
+			return
 		}
+		if _, ok := s.PlayerIDByAddr(packet_data.Addr); !ok {
+			return
+		}
+		offered := slices.ContainsFunc(s.State.Context.ModifiersOptions, func(option Modifiers) bool {
+			return option.Equals(modifiers)
+		})
+		if !offered {
+			fmt.Println("player chose modifiers that were not offered")
+			return
+		}
+
+		s.State.Context.HasChosenOptions = true
+
+		s.Modifiers.Add(modifiers)
+		packet := Packet{}
+		packet.PacketType = PacketTypeModifiersUpdated
+
+		s.Broadcast(packet, s.Modifiers)
+
+	case PacketTypeBulletStart:
+		var bullet Bullet
+		err := dec.Decode(&bullet)
+		if err != nil {
+			fmt.Println("error decoding bullet", err)
+			return
+		}
+
+		id, ok := s.PlayerIDByAddr(packet_data.Addr)
+		if !ok {
+			return
+		}
+		ok = s.updatePlayer(id, func(player *ConnectedPlayer) {
+			err = s.validateBullet(player, &bullet)
+		})
+		if !ok {
+			return
+		}
+		if err != nil {
+			fmt.Println("refusing bullet:", err)
+			return
+		}
+		s.Broadcast(packet_data.Packet, bullet)
+
+		s.bullets_mutex.Lock()
+		s.bullets = append(s.bullets, bullet)
+		s.bullets_mutex.Unlock()
 	}
 }
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// startTestServer starts a server on network that nobody but the test drives, see Server.Step
+func startTestServer(t *testing.T, network *MemoryNetwork, config Config) *Server {
+	t.Helper()
+	conn, err := network.Listen(config.ServerListenAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &Server{}
+	server.UseTransport(conn)
+	// kept off the lobby list
+	config.MediationAddr = ""
+	err = server.Start(config, JOIN_KEY_PREFIX+"TEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	return server
+}
+
+// startTestClient connects a client to server over network, set up the way the game sets up its own
+func startTestClient(t *testing.T, network *MemoryNetwork, config Config, server *Server) *Client {
+	t.Helper()
+	conn, err := network.Listen(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &Client{}
+	client.Modifiers = &Modifiers{}
+	life := PLAYER_LIFE
+	client.PlayerLifePtr = &life
+	client.SetInterpolation(config)
+	client.UseTransport(conn)
+	err = client.StartDirectClient(config, *server.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+	return client
+}
+
+// stepUntil ticks the server and lets everyone handle their packets until done, datagrams on a
+// MemoryNetwork are read on their own goroutines so it can take a few rounds for them to arrive
+func stepUntil(t *testing.T, what string, server *Server, clients []*Client, done func() bool) {
+	t.Helper()
+	end := time.Now().Add(time.Second * 5)
+	for !done() {
+		if time.Now().After(end) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+
+		server.Step()
+		server.Update(SERVER_TICK.Seconds())
+		for _, client := range clients {
+			client.Step()
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLobbyToLevel(t *testing.T) {
+	config := DefaultConfig()
+	config.BindAddr = "127.0.0.1"
+	network := NewMemoryNetwork()
+	server := startTestServer(t, network, config)
+
+	clients := []*Client{}
+	for i := 0; i < 3; i++ {
+		clients = append(clients, startTestClient(t, network, config, server))
+	}
+
+	stepUntil(t, "everyone to connect", server, clients, func() bool {
+		for _, client := range clients {
+			if client.ID == 0 {
+				return false
+			}
+		}
+		return len(server.GetAlivePlayers()) == len(clients)
+	})
+	if server.State.State != ServerStateWaitingRoom || server.LevelType() != LobbyLevel {
+		t.Fatalf("started in state %d on level %d, want the waiting room in the lobby", server.State.State, server.LevelType())
+	}
+
+	// nobody starts until the last player is ready
+	for _, client := range clients[:len(clients)-1] {
+		client.ToggleReady()
+	}
+	stepUntil(t, "the first players to be ready", server, clients, func() bool {
+		ready := 0
+		for _, player := range server.GetAlivePlayers() {
+			if player.IsReady {
+				ready++
+			}
+		}
+		return ready == len(clients)-1
+	})
+	if server.State.State != ServerStateWaitingRoom {
+		t.Fatalf("in state %d with a player not ready", server.State.State)
+	}
+
+	clients[len(clients)-1].ToggleReady()
+	stepUntil(t, "the game to start", server, clients, func() bool {
+		return server.State.State == ServerStateStarting
+	})
+
+	// skipping the countdown
+	server.State.Context.Time = time.Now()
+	stepUntil(t, "the first level", server, clients, func() bool {
+		for _, client := range clients {
+			if client.ServerState.State != ServerStatePlaying {
+				return false
+			}
+		}
+		return true
+	})
+
+	if server.State.State != ServerStatePlaying || server.LevelType() == LobbyLevel {
+		t.Errorf("in state %d on level %d, want a level being played", server.State.State, server.LevelType())
+	}
+	for i, client := range clients {
+		if client.ServerState.Context.Level != server.LevelType() {
+			t.Errorf("client %d is on level %d, the server on %d", i, client.ServerState.Context.Level, server.LevelType())
+		}
+	}
+}
+
+func TestBulletHitsRewoundEnemy(t *testing.T) {
+	config := DefaultConfig()
+	config.BindAddr = "127.0.0.1"
+
+	for _, c := range []struct {
+		name   string
+		rewind int64
+		hit    bool
+	}{
+		{"where the shooter saw it", 150, true},
+		{"where it is now", 0, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			server := startTestServer(t, NewMemoryNetwork(), config)
+
+			// it stood at seen until 100ms ago and has just moved away
+			seen := Position{100, 100}
+			now := NowMillis()
+			enemy := Enemy{ID: 1, Type: CharacterZombie, Position: Position{400, 400}, Life: 100}
+			enemy.Snapshots.Push(Snapshot{now - 300, seen, 0})
+			enemy.Snapshots.Push(Snapshot{now - 100, seen, 0})
+			enemy.Snapshots.Push(Snapshot{now, enemy.Position, 0})
+			server.Enemies = []Enemy{enemy}
+
+			bullet := Bullet{Position: Position{seen.X + 4, seen.Y + 4}, WeaponType: WeaponBow}
+			bullet.rewind = c.rewind
+			server.bullets = []Bullet{bullet}
+
+			server.Update(SERVER_TICK.Seconds())
+
+			if len(server.Enemies) != 1 {
+				t.Fatalf("got %d enemies, want 1", len(server.Enemies))
+			}
+			hit := server.Enemies[0].Life < enemy.Life
+			if hit != c.hit {
+				t.Errorf("hit is %v, want %v", hit, c.hit)
+			}
+		})
+	}
+}
+
+// what a run turned out like, the same seed has to give the same run
+type runRecord struct {
+	Levels []LevelEnum
+	Spawns []EnemySnapshot
+	Boons  [][]Modifiers
+}
+
+// playRun plays levels levels of a run with seed with a single player that is never in danger,
+// every enemy dies as soon as it spawns and the first boon is always taken
+func playRun(t *testing.T, seed int, levels int) runRecord {
+	t.Helper()
+	config := DefaultConfig()
+	config.BindAddr = "127.0.0.1"
+	config.Seed = seed
+	server := startTestServer(t, NewMemoryNetwork(), config)
+
+	player := ConnectedPlayer{Addr: testAddr(1), ID: 1, IsReady: true, Life: PLAYER_LIFE}
+	server.connection_keys_mutex.Lock()
+	server.AddConnection(player)
+	server.connection_keys_mutex.Unlock()
+
+	record := runRecord{}
+	last_enemy := uint(0)
+	for tick := 0; len(record.Boons) < levels; tick++ {
+		if tick > 100000 {
+			t.Fatalf("run didn't get through %d levels, got %+v", levels, record)
+		}
+
+		server.updatePlayer(player.ID, func(player *ConnectedPlayer) {
+			player.TimeLastPacket = uint64(NowMillis())
+		})
+		state := server.State.State
+		server.Update(SERVER_TICK.Seconds())
+
+		switch server.State.State {
+		case ServerStateStarting:
+			// skipping the countdown
+			server.State.Context.Time = time.Now()
+		case ServerStatePlaying:
+			if state != ServerStatePlaying {
+				record.Levels = append(record.Levels, server.LevelType())
+			}
+		case ServerStateLevelCompleted:
+			if !server.State.Context.HasChosenOptions {
+				record.Boons = append(record.Boons, server.State.Context.ModifiersOptions)
+				server.State.Context.HasChosenOptions = true
+				server.Modifiers.Add(server.State.Context.ModifiersOptions[0])
+			}
+		case ServerStateGameOver:
+			t.Fatalf("player died on tick %d", tick)
+		}
+
+		for i := range server.Enemies {
+			if server.Enemies[i].ID > last_enemy {
+				last_enemy = server.Enemies[i].ID
+				snapshot := server.Enemies[i].Snapshot()
+				// how far it got on its first tick isn't part of the spawn
+				snapshot.Lifetime = 0
+				record.Spawns = append(record.Spawns, snapshot)
+			}
+			server.Enemies[i].Life = 0
+		}
+	}
+	return record
+}
+
+func TestSameSeedSameRun(t *testing.T) {
+	first := playRun(t, 1234, 3)
+	second := playRun(t, 1234, 3)
+
+	if len(first.Spawns) == 0 {
+		t.Fatalf("nothing spawned in %+v", first)
+	}
+	t.Logf("levels %v with %d enemies spawned", first.Levels, len(first.Spawns))
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("the same seed played out differently:\n%+v\n%+v", first, second)
+	}
+
+	other := playRun(t, 4321, 3)
+	if reflect.DeepEqual(first, other) {
+		t.Errorf("seeds 1234 and 4321 played out the same: %+v", first)
+	}
+}
+
+func TestModifierChosenOnlyFromOptions(t *testing.T) {
+	config := DefaultConfig()
+	config.BindAddr = "127.0.0.1"
+	network := NewMemoryNetwork()
+	server := startTestServer(t, network, config)
+	clients := []*Client{startTestClient(t, network, config, server)}
+	stepUntil(t, "the player to connect", server, clients, func() bool {
+		return len(server.GetAlivePlayers()) == 1
+	})
+	player_addr := server.GetAlivePlayers()[0].Addr
+
+	options := testModifiers()
+	choose := func(modifiers Modifiers, from net.UDPAddr) {
+		packet := Packet{PacketType: PacketTypeModifierChosen}
+		server.handlePacket(PacketData{packet, encodeTest(t, modifiers), from})
+	}
+	chosen := func() int {
+		return len(server.Modifiers.Monster) + len(server.Modifiers.Player)
+	}
+
+	choose(options[0], player_addr)
+	if chosen() != 0 {
+		t.Fatalf("took modifiers in state %d", server.State.State)
+	}
+
+	server.State.State = ServerStateLevelCompleted
+	server.State.Context.ModifiersOptions = options
+	server.State.Context.HasChosenOptions = false
+
+	choose(Modifiers{Player: []Modifier{{ModifierCalcTypeMulti, ModifierTypeLife, 100}}}, player_addr)
+	choose(options[1], testAddr(9))
+	if chosen() != 0 || server.State.Context.HasChosenOptions {
+		t.Fatalf("took modifiers that were not offered or from a stranger")
+	}
+
+	choose(options[1], player_addr)
+	if !server.Modifiers.Equals(options[1]) || !server.State.Context.HasChosenOptions {
+		t.Fatalf("got %+v, want %+v", server.Modifiers, options[1])
+	}
+
+	// a second pick for the same level does nothing
+	choose(options[0], player_addr)
+	if !server.Modifiers.Equals(options[1]) {
+		t.Errorf("picked twice, got %+v", server.Modifiers)
+	}
+}
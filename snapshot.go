@@ -0,0 +1,131 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+const (
+	// how far behind the server's clock remote entities are shown, enough to always have
+	// an update on either side even if one gets lost
+	DEFAULT_INTERPOLATION_DELAY_MS = 100
+	// how long we keep moving an entity the way it was going once we run out of updates
+	DEFAULT_EXTRAPOLATION_LIMIT_MS = 250
+	// updates older than this many are forgotten
+	SNAPSHOT_BUFFER_SIZE = 32
+)
+
+// where an entity was at a point in server time
+type Snapshot struct {
+	Time     int64
+	Position Position
+	Rotation float64
+}
+
+// SnapshotBuffer keeps the recent updates of a single entity ordered by server time,
+// so it can be shown smoothly a little in the past no matter how the updates arrive
+type SnapshotBuffer struct {
+	// a ring of the newest updates, oldest first from start. An array so buffers that
+	// were copied along with their PlayerState or Enemy don't share anything
+	snapshots [SNAPSHOT_BUFFER_SIZE]Snapshot
+	start     int
+	count     int
+}
+
+func (sb *SnapshotBuffer) at(i int) *Snapshot {
+	return &sb.snapshots[(sb.start+i)%SNAPSHOT_BUFFER_SIZE]
+}
+
+// Push adds an update, updates that arrive out of order are put where they belong
+// and a second update for the same time replaces the first
+func (sb *SnapshotBuffer) Push(snapshot Snapshot) {
+	i := sort.Search(sb.count, func(i int) bool {
+		return sb.at(i).Time >= snapshot.Time
+	})
+
+	if i < sb.count && sb.at(i).Time == snapshot.Time {
+		*sb.at(i) = snapshot
+		return
+	}
+
+	if sb.count == SNAPSHOT_BUFFER_SIZE {
+		// older than everything we keep
+		if i == 0 {
+			return
+		}
+		sb.start = (sb.start + 1) % SNAPSHOT_BUFFER_SIZE
+		sb.count--
+		i--
+	}
+
+	// updates usually arrive in order, then nothing has to move
+	for j := sb.count; j > i; j-- {
+		*sb.at(j) = *sb.at(j - 1)
+	}
+	*sb.at(i) = snapshot
+	sb.count++
+}
+
+func (sb *SnapshotBuffer) Len() int {
+	return sb.count
+}
+
+func (sb *SnapshotBuffer) Latest() Snapshot {
+	if sb.count == 0 {
+		return Snapshot{}
+	}
+	return *sb.at(sb.count - 1)
+}
+
+// Sample returns where the entity was at renderTime. Between two updates it is interpolated,
+// after the last one it keeps going for at most extrapolationLimit ms and then stops
+func (sb *SnapshotBuffer) Sample(renderTime int64, extrapolationLimit int64) Snapshot {
+	if sb.count == 0 {
+		return Snapshot{}
+	}
+
+	first := *sb.at(0)
+	if renderTime <= first.Time {
+		return first
+	}
+
+	last := *sb.at(sb.count - 1)
+	if renderTime >= last.Time {
+		if sb.count < 2 {
+			return last
+		}
+
+		previous := *sb.at(sb.count - 2)
+		duration := float64(last.Time - previous.Time)
+		ahead := float64(min(renderTime-last.Time, extrapolationLimit))
+
+		extrapolated := last
+		extrapolated.Time = renderTime
+		extrapolated.Position.X += (last.Position.X - previous.Position.X) / duration * ahead
+		extrapolated.Position.Y += (last.Position.Y - previous.Position.Y) / duration * ahead
+		return extrapolated
+	}
+
+	// the first update after renderTime, there always is one before it as well
+	i := sort.Search(sb.count, func(i int) bool {
+		return sb.at(i).Time > renderTime
+	})
+	from := *sb.at(i - 1)
+	to := *sb.at(i)
+
+	f := float64(renderTime-from.Time) / float64(to.Time-from.Time)
+	return Snapshot{
+		renderTime,
+		Position{
+			from.Position.X + f*(to.Position.X-from.Position.X),
+			from.Position.Y + f*(to.Position.Y-from.Position.Y),
+		},
+		LerpAngle(from.Rotation, to.Rotation, f),
+	}
+}
+
+// LerpAngle turns from a towards b the short way around
+func LerpAngle(a float64, b float64, f float64) float64 {
+	diff := math.Remainder(b-a, 2*math.Pi)
+	return math.Remainder(a+diff*f, 2*math.Pi)
+}
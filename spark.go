@@ -8,7 +8,7 @@ import (
 	"github.com/hajimehoshi/ebiten/v2/vector"
 )
 
-var polygonImage *ebiten.Image = ebiten.NewImage(1, 1)
+var polygonImage *ebiten.Image
 
 type Spark struct {
 	Lifetime float64
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// Transport is what the client, the server and the mediation server send and receive datagrams with.
+// A *net.UDPConn is one, SimulatedTransport wraps one to make the network worse on purpose
+// and MemoryTransport needs no socket at all
+type Transport interface {
+	ReadFromUDP(b []byte) (int, *net.UDPAddr, error)
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+	Close() error
+	LocalAddr() net.Addr
+}
+
+// ListenTransport opens a socket on addr, nil picks any port, and puts the network conditions
+// from the config in front of it if there are any
+func ListenTransport(config Config, addr *net.UDPAddr) (Transport, error) {
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conditions := config.NetConditions()
+	if !conditions.Enabled() {
+		return conn, nil
+	}
+
+	fmt.Printf("simulating %s on %s\n", conditions, conn.LocalAddr())
+	return NewSimulatedTransport(conn, conditions), nil
+}
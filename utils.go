@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"image/color"
 	"math"
+	"net"
+	"strconv"
 
 	"github.com/hajimehoshi/ebiten/v2"
 	"github.com/hajimehoshi/ebiten/v2/ebitenutil"
@@ -39,6 +41,15 @@ func GetSpriteByID(ID int) *ebiten.Image {
 	return player_sprite
 }
 
+// ResolveHostAddr accepts a host with or without a port, defaultPort is used when it has none
+func ResolveHostAddr(host string, defaultPort int) (*net.UDPAddr, error) {
+	_, _, err := net.SplitHostPort(host)
+	if err != nil {
+		host = net.JoinHostPort(host, strconv.Itoa(defaultPort))
+	}
+	return net.ResolveUDPAddr("udp", host)
+}
+
 func (p *Position) Distance(other Position) float64 {
 	xDelta := p.X - other.X
 	yDelta := p.Y - other.Y